@@ -0,0 +1,234 @@
+package shepherd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Values for Archive.Format
+const (
+	ArchiveFormatTarGz  = "tar.gz"
+	ArchiveFormatTarZst = "tar.zst"
+	ArchiveFormatZip    = "zip"
+)
+
+// shepherdDir is a directory within the work directory where shepherd stages
+// files of its own, such as archives, before uploading them. It is never
+// treated as an output of the command.
+const shepherdDir = ".shepherd"
+
+// Archive bundles all of the files selected by an upload rule into a single
+// compressed archive, which is uploaded to DestinationURLPrefix/Name along with
+// a listing of its content (Name + ".listing.json"). Within the archive, files
+// are named by the path they would otherwise have been uploaded to.
+type Archive struct {
+	Format string `json:"format"`
+	// Name defaults to "outputs." followed by the extension for Format
+	Name string `json:"name"`
+}
+
+// ArchiveListingEntry describes a single file within an archive
+type ArchiveListingEntry struct {
+	Path          string `json:"path"`
+	SourcePath    string `json:"source_path"`
+	Size          int64  `json:"size"`
+	SymlinkTarget string `json:"symlink_target,omitempty"`
+}
+
+func validateArchive(archive *Archive) error {
+	switch archive.Format {
+	case ArchiveFormatTarGz, ArchiveFormatTarZst, ArchiveFormatZip:
+	default:
+		return fmt.Errorf("unknown archive format %q, expected %q, %q or %q", archive.Format, ArchiveFormatTarGz, ArchiveFormatTarZst, ArchiveFormatZip)
+	}
+	if archive.Name != "" {
+		return validatePath(archive.Name)
+	}
+	return nil
+}
+
+func (archive *Archive) name() string {
+	if archive.Name != "" {
+		return archive.Name
+	}
+	return "outputs." + archive.Format
+}
+
+// archiveUploads writes the given files into an archive and returns the
+// uploads for the archive and its listing, which take the place of uploading
+// each file individually. Each rule stages its archive under its own index.
+func archiveUploads(workdir string, ruleIndex int, destinationURLPrefix string, archive *Archive, entries []*selectedFile) ([]*Upload, error) {
+	name := archive.name()
+	archivePath := path.Join(shepherdDir, "archives", strconv.Itoa(ruleIndex), name)
+	listingPath := archivePath + ".listing.json"
+
+	err := ensureParentDirExists(path.Join(workdir, archivePath))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if other, exists := seen[entry.path]; exists {
+			return nil, fmt.Errorf("both %s and %s would be archived as %s", other, entry.upload.SourcePath, entry.path)
+		}
+		seen[entry.path] = entry.upload.SourcePath
+	}
+
+	log.Printf("Archiving %d files into %s", len(entries), archivePath)
+	listing, err := writeArchive(workdir, path.Join(workdir, archivePath), archive.Format, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(listing, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path.Join(workdir, listingPath), b, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*Upload{
+		&Upload{SourcePath: archivePath, DestinationURL: joinURL(destinationURLPrefix, name)},
+		&Upload{SourcePath: listingPath, DestinationURL: joinURL(destinationURLPrefix, name+".listing.json")},
+	}, nil
+}
+
+func writeArchive(workdir string, archivePath string, format string, entries []*selectedFile) ([]*ArchiveListingEntry, error) {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var add func(entry *selectedFile, fi os.FileInfo) error
+	var closers []io.Closer
+
+	switch format {
+	case ArchiveFormatZip:
+		zw := zip.NewWriter(f)
+		closers = append(closers, zw)
+		add = func(entry *selectedFile, fi os.FileInfo) error {
+			return addZipEntry(zw, workdir, entry, fi)
+		}
+	default:
+		var compressor io.WriteCloser
+		if format == ArchiveFormatTarZst {
+			compressor, err = zstd.NewWriter(f)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			compressor = gzip.NewWriter(f)
+		}
+		tw := tar.NewWriter(compressor)
+		closers = append(closers, tw, compressor)
+		add = func(entry *selectedFile, fi os.FileInfo) error {
+			return addTarEntry(tw, workdir, entry, fi)
+		}
+	}
+
+	listing := make([]*ArchiveListingEntry, 0, len(entries))
+	for _, entry := range entries {
+		fi, err := archiveEntryInfo(workdir, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		err = add(entry, fi)
+		if err != nil {
+			return nil, err
+		}
+
+		listing = append(listing, &ArchiveListingEntry{Path: entry.path,
+			SourcePath:    entry.upload.SourcePath,
+			Size:          fi.Size(),
+			SymlinkTarget: entry.upload.SymlinkTarget})
+	}
+
+	for _, closer := range closers {
+		err = closer.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return listing, f.Close()
+}
+
+// archiveEntryInfo describes the link itself for symlinks which are to be
+// recorded as such, and otherwise whatever the path points to
+func archiveEntryInfo(workdir string, entry *selectedFile) (os.FileInfo, error) {
+	absPath := path.Join(workdir, entry.upload.SourcePath)
+	if entry.upload.SymlinkTarget != "" {
+		return os.Lstat(absPath)
+	}
+	return os.Stat(absPath)
+}
+
+func addTarEntry(tw *tar.Writer, workdir string, entry *selectedFile, fi os.FileInfo) error {
+	header, err := tar.FileInfoHeader(fi, entry.upload.SymlinkTarget)
+	if err != nil {
+		return err
+	}
+	header.Name = entry.path
+
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if entry.upload.SymlinkTarget != "" {
+		return nil
+	}
+	return copyFileTo(tw, path.Join(workdir, entry.upload.SourcePath))
+}
+
+func addZipEntry(zw *zip.Writer, workdir string, entry *selectedFile, fi os.FileInfo) error {
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	header.Name = entry.path
+
+	if entry.upload.SymlinkTarget != "" {
+		// by convention, zip stores the target of a symlink as its content
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, entry.upload.SymlinkTarget)
+		return err
+	}
+
+	header.Method = zip.Deflate
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return copyFileTo(w, path.Join(workdir, entry.upload.SourcePath))
+}
+
+func copyFileTo(w io.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,132 @@
+package shepherd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTar(t *testing.T, r io.Reader) map[string]string {
+	content := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		if header.Typeflag == tar.TypeSymlink {
+			content[header.Name] = "-> " + header.Linkname
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		require.Nil(t, err)
+		content[header.Name] = string(b)
+	}
+	return content
+}
+
+func readZip(t *testing.T, b []byte) map[string]string {
+	content := make(map[string]string)
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	require.Nil(t, err)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		require.Nil(t, err)
+		b, err := ioutil.ReadAll(r)
+		require.Nil(t, err)
+		r.Close()
+		content[f.Name] = string(b)
+	}
+	return content
+}
+
+func runArchiveJob(t *testing.T, archive *Archive) *MockUploader {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		UploadRules: []*UploadPatterns{
+			{Filters: []*Filter{{Pattern: "*.log"}}, DestinationURLPrefix: "gs://mock/logs"},
+			{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://mock/out", StripComponents: 1, SymlinkPolicy: SymlinkPolicyMetadata, Archive: archive},
+		},
+		Command: []string{"bash", "-c", "mkdir -p parts/sub && echo -n a > parts/a && echo -n b > parts/sub/b && ln -s a parts/link && echo -n log > run.log"}}
+
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.Nil(t, err)
+	return uploader
+}
+
+var expectedArchiveContent = map[string]string{"a": "a", "sub/b": "b", "link": "-> a"}
+
+func TestArchiveTarGz(t *testing.T) {
+	uploader := runArchiveJob(t, &Archive{Format: ArchiveFormatTarGz})
+
+	assert.Equal(t, "log", uploader.uploaded["gs://mock/logs/run.log"])
+	gz, err := gzip.NewReader(bytes.NewReader([]byte(uploader.uploaded["gs://mock/out/outputs.tar.gz"])))
+	require.Nil(t, err)
+	assert.Equal(t, expectedArchiveContent, readTar(t, gz))
+
+	listing := []*ArchiveListingEntry{}
+	require.Nil(t, json.Unmarshal([]byte(uploader.uploaded["gs://mock/out/outputs.tar.gz.listing.json"]), &listing))
+	paths := make([]string, len(listing))
+	for i, entry := range listing {
+		paths[i] = entry.Path
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"a", "link", "sub/b"}, paths)
+}
+
+func TestArchiveTarZst(t *testing.T) {
+	uploader := runArchiveJob(t, &Archive{Format: ArchiveFormatTarZst, Name: "bundle.tar.zst"})
+
+	zr, err := zstd.NewReader(bytes.NewReader([]byte(uploader.uploaded["gs://mock/out/bundle.tar.zst"])))
+	require.Nil(t, err)
+	defer zr.Close()
+	assert.Equal(t, expectedArchiveContent, readTar(t, zr))
+}
+
+func TestArchiveZip(t *testing.T) {
+	uploader := runArchiveJob(t, &Archive{Format: ArchiveFormatZip})
+
+	assert.Equal(t, map[string]string{"a": "a", "sub/b": "b", "link": "a"},
+		readZip(t, []byte(uploader.uploaded["gs://mock/out/outputs.zip"])))
+}
+
+func TestArchiveRules(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		UploadRules: []*UploadPatterns{
+			{Filters: []*Filter{{Pattern: "a/*"}}, DestinationURLPrefix: "gs://one", Archive: &Archive{Format: ArchiveFormatZip}},
+			{Filters: []*Filter{{Pattern: "b/*"}}, DestinationURLPrefix: "gs://two", Archive: &Archive{Format: ArchiveFormatZip}},
+		},
+		Command: []string{"bash", "-c", "mkdir a b && echo -n x > a/x && echo -n y > b/y"}}
+
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"a/x": "x"}, readZip(t, []byte(uploader.uploaded["gs://one/outputs.zip"])))
+	assert.Equal(t, map[string]string{"b/y": "y"}, readZip(t, []byte(uploader.uploaded["gs://two/outputs.zip"])))
+}
+
+func TestValidateArchive(t *testing.T) {
+	assert.NotNil(t, validateArchive(&Archive{Format: "rar"}))
+	assert.NotNil(t, validateArchive(&Archive{Format: ArchiveFormatZip, Name: "/abs.zip"}))
+	assert.Nil(t, validateArchive(&Archive{Format: ArchiveFormatZip, Name: "out/all.zip"}))
+}
@@ -0,0 +1,139 @@
+package shepherd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sync"
+)
+
+// TransferFactory creates the localizer and uploader for a job whose work
+// directory is workdir, within jobRoot
+type TransferFactory func(jobRoot string, workdir string) (Localizer, Uploader)
+
+// Batch runs every job of a JSONL stream of Parameters, each in a new
+// directory within WorkRoot, running up to Concurrency jobs at a time.
+type Batch struct {
+	WorkRoot    string
+	Concurrency int
+	Cleanup     string
+	NewTransfer TransferFactory
+}
+
+// BatchResult summarizes a job of a batch. Jobs are identified by the line
+// they were read from, along with their job_id if they have one.
+type BatchResult struct {
+	Line     int    `json:"line"`
+	JobID    string `json:"job_id,omitempty"`
+	WorkDir  string `json:"work_dir,omitempty"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Run executes the jobs read from r, writing a BatchResult to summary as each
+// one completes. It returns the number of jobs which did not succeed. Once
+// ctx is cancelled, running jobs are killed and no more are started.
+func (b *Batch) Run(ctx context.Context, r io.Reader, summary io.Writer) (int, error) {
+	concurrency := b.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var writeErr error
+	failed := 0
+	record := func(result *BatchResult) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if result.Status != StatusSuccess {
+			failed++
+		}
+		b, err := json.Marshal(result)
+		if err == nil {
+			_, err = fmt.Fprintf(summary, "%s\n", b)
+		}
+		if err != nil && writeErr == nil {
+			writeErr = err
+		}
+	}
+
+	slots := make(chan bool, concurrency)
+	reader := bufio.NewReader(r)
+	var readErr error
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			readErr = err
+			break
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			select {
+			case slots <- true:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				readErr = ctx.Err()
+				break
+			}
+
+			wg.Add(1)
+			go func(lineNumber int, line []byte) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				record(b.runJob(ctx, lineNumber, line))
+			}(lineNumber, line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	wg.Wait()
+	if readErr != nil {
+		return failed, readErr
+	}
+	return failed, writeErr
+}
+
+func (b *Batch) runJob(ctx context.Context, lineNumber int, line []byte) *BatchResult {
+	result := &BatchResult{Line: lineNumber, ExitCode: -1}
+
+	params, err := LoadParameters(line, ParamsFormatJSON)
+	if err == nil {
+		result.JobID = params.JobID
+		// check before creating anything for the job
+		err = validateParameters(params)
+	}
+	if err != nil {
+		result.Status = StatusInvalidParameters
+		result.Error = err.Error()
+		return result
+	}
+
+	jobRoot, err := newTempJobRoot(b.WorkRoot, fmt.Sprintf("job-%d-", lineNumber))
+	if err != nil {
+		result.Status = StatusInternalError
+		result.Error = err.Error()
+		return result
+	}
+	workdir := path.Join(jobRoot.Path, "work")
+	result.WorkDir = workdir
+
+	log.Printf("Executing job from line %d in %s", lineNumber, workdir)
+	localizer, uploader := b.NewTransfer(jobRoot.Path, workdir)
+	results, err := ExecuteResults(ctx, workdir, workdir, params, localizer, uploader)
+	jobRoot.cleanupAfter(b.Cleanup, results.Status)
+	result.Status = results.Status
+	result.ExitCode = results.ExitCode
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package shepherd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	workRoot, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workRoot)
+
+	jobs := strings.Join([]string{
+		`{"job_id": "first", "command": ["true"]}`,
+		``,
+		`{"command": ["false"]}`,
+		`{"command": ["true"], "unknown": 1}`,
+		`{"job_id": "last", "command": ["bash", "-c", "exit 3"]}`,
+	}, "\n")
+
+	batch := &Batch{WorkRoot: workRoot,
+		Concurrency: 2,
+		Cleanup:     CleanupDeleteOnSuccess,
+		NewTransfer: func(jobRoot string, workdir string) (Localizer, Uploader) {
+			return NewMockLocalizer(workdir), NewMockUploader(workdir)
+		}}
+
+	var summary bytes.Buffer
+	failed, err := batch.Run(context.Background(), strings.NewReader(jobs), &summary)
+	require.Nil(t, err)
+	assert.Equal(t, 3, failed)
+
+	results := make([]*BatchResult, 0)
+	for _, line := range strings.Split(strings.TrimSpace(summary.String()), "\n") {
+		result := &BatchResult{}
+		require.Nil(t, json.Unmarshal([]byte(line), result))
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Line < results[j].Line })
+
+	require.Len(t, results, 4)
+	assert.Equal(t, []int{1, 3, 4, 5}, []int{results[0].Line, results[1].Line, results[2].Line, results[3].Line})
+	assert.Equal(t, "first", results[0].JobID)
+	assert.Equal(t, StatusSuccess, results[0].Status)
+	assert.Equal(t, StatusCommandFailed, results[1].Status)
+	assert.Equal(t, 1, results[1].ExitCode)
+	assert.Equal(t, StatusInvalidParameters, results[2].Status)
+	assert.Contains(t, results[2].Error, "unknown")
+	assert.Equal(t, "last", results[3].JobID)
+	assert.Equal(t, 3, results[3].ExitCode)
+	assert.NotEqual(t, results[0].WorkDir, results[3].WorkDir)
+
+	// only the directories of failed jobs are kept
+	_, err = os.Stat(results[0].WorkDir)
+	assert.True(t, os.IsNotExist(err))
+	assert.DirExists(t, results[3].WorkDir)
+}
+
+func TestBatchCancelled(t *testing.T) {
+	workRoot, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workRoot)
+
+	jobs := strings.Join([]string{
+		`{"job_id": "slow", "command": ["sleep", "10"]}`,
+		`{"job_id": "never", "command": ["true"]}`,
+	}, "\n")
+
+	batch := &Batch{WorkRoot: workRoot,
+		Concurrency: 1,
+		NewTransfer: func(jobRoot string, workdir string) (Localizer, Uploader) {
+			return NewMockLocalizer(workdir), NewMockUploader(workdir)
+		}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	var summary bytes.Buffer
+	start := time.Now()
+	failed, err := batch.Run(ctx, strings.NewReader(jobs), &summary)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, 1, failed)
+
+	// the running job is still summarized, and the next is never started
+	result := &BatchResult{}
+	require.Nil(t, json.Unmarshal(bytes.TrimSpace(summary.Bytes()), result))
+	assert.Equal(t, "slow", result.JobID)
+	assert.NotEqual(t, StatusSuccess, result.Status)
+}
@@ -0,0 +1,212 @@
+package shepherd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cpuPeriod is the cpu.max period (in microseconds) used when converting a
+// number of CPUs into a quota
+const cpuPeriod = 100000
+
+// cgroup is a cgroups v2 group created to hold a single command
+type cgroup struct {
+	path string
+}
+
+// cgroupParent is the cgroup beneath which a cgroup is created for each
+// command, set up by setupCgroupParent the first time limits are needed
+var cgroupParent struct {
+	once sync.Once
+	path string
+	// enabled lists the controllers available to the commands' cgroups
+	enabled map[string]bool
+	err     error
+}
+
+// newCgroup creates a cgroup beneath the one shepherd is running in, with the
+// given limits applied.
+func newCgroup(name string, resources *ResourceLimits) (*cgroup, error) {
+	cgroupParent.once.Do(func() {
+		cgroupParent.path, cgroupParent.enabled, cgroupParent.err = setupCgroupParent()
+	})
+	if cgroupParent.err != nil {
+		return nil, cgroupParent.err
+	}
+	if resources.MemoryBytes > 0 && !cgroupParent.enabled["memory"] {
+		return nil, fmt.Errorf("the memory controller is not available in %s", cgroupParent.path)
+	}
+	if resources.CPUs > 0 && !cgroupParent.enabled["cpu"] {
+		return nil, fmt.Errorf("the cpu controller is not available in %s", cgroupParent.path)
+	}
+
+	cg := &cgroup{path: path.Join(cgroupParent.path, name)}
+	err := os.Mkdir(cg.path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if resources.MemoryBytes > 0 {
+		err = cg.write("memory.max", strconv.FormatInt(resources.MemoryBytes, 10))
+		if err == nil {
+			// not all kernels are built with swap accounting, so tolerate this one failing
+			if swapErr := cg.write("memory.swap.max", "0"); swapErr != nil {
+				log.Printf("Warning: could not disable swap for %s: %s", cg.path, swapErr)
+			}
+		}
+	}
+	if err == nil && resources.CPUs > 0 {
+		err = cg.write("cpu.max", formatCPUMax(resources.CPUs))
+	}
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// setupCgroupParent enables the memory and cpu controllers, where available,
+// for the children of the cgroup shepherd was started in. This happens once,
+// as doing so may move shepherd into a cgroup of its own (see
+// enableControllers), after which /proc/self/cgroup no longer names the
+// cgroup it was started in.
+func setupCgroupParent() (string, map[string]bool, error) {
+	if _, err := os.Stat(path.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", nil, fmt.Errorf("resource limits on host commands require cgroups v2 mounted at %s: %s", cgroupRoot, err)
+	}
+
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", nil, err
+	}
+	ownPath, err := parseCgroupPath(string(b))
+	if err != nil {
+		return "", nil, err
+	}
+	parent := path.Join(cgroupRoot, ownPath)
+
+	b, err = ioutil.ReadFile(path.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return "", nil, err
+	}
+	enabled := make(map[string]bool)
+	controllers := make([]string, 0, 2)
+	for _, controller := range strings.Fields(string(b)) {
+		if controller == "memory" || controller == "cpu" {
+			enabled[controller] = true
+			controllers = append(controllers, controller)
+		}
+	}
+
+	err = enableControllers(parent, controllers)
+	if err != nil {
+		return "", nil, err
+	}
+	return parent, enabled, nil
+}
+
+// parseCgroupPath extracts the cgroups v2 path from the contents of
+// /proc/<pid>/cgroup
+func parseCgroupPath(content string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", errors.New("could not find cgroups v2 entry in /proc/self/cgroup")
+}
+
+func formatCPUMax(cpus float64) string {
+	quota := int64(cpus * cpuPeriod)
+	if quota < 1000 {
+		// the kernel rejects quotas below 1ms
+		quota = 1000
+	}
+	return fmt.Sprintf("%d %d", quota, cpuPeriod)
+}
+
+// enableControllers makes the given controllers available to the children of
+// parent. cgroups v2 does not allow this while processes live in parent itself,
+// so if needed shepherd first moves itself into a leaf cgroup of its own,
+// parent/shepherd-supervisor, where it stays for the rest of its life.
+func enableControllers(parent string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	subtreeControl := path.Join(parent, "cgroup.subtree_control")
+	value := "+" + strings.Join(controllers, " +")
+	err := ioutil.WriteFile(subtreeControl, []byte(value), 0644)
+	if err == nil {
+		return nil
+	}
+
+	supervisor := path.Join(parent, "shepherd-supervisor")
+	err = ensureDirExists(supervisor)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(supervisor, "cgroup.procs"), []byte("0"), 0644)
+	if err != nil {
+		return fmt.Errorf("could not move shepherd into %s: %s", supervisor, err)
+	}
+
+	err = ioutil.WriteFile(subtreeControl, []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("could not enable %s controllers in %s: %s", strings.Join(controllers, ", "), parent, err)
+	}
+	return nil
+}
+
+func (c *cgroup) write(filename string, value string) error {
+	return ioutil.WriteFile(path.Join(c.path, filename), []byte(value), 0644)
+}
+
+func (c *cgroup) procsPath() string {
+	return path.Join(c.path, "cgroup.procs")
+}
+
+// oomKilled reports whether the kernel killed any process in the cgroup for
+// exceeding memory.max
+func (c *cgroup) oomKilled() (bool, error) {
+	b, err := ioutil.ReadFile(path.Join(c.path, "memory.events"))
+	if os.IsNotExist(err) {
+		// memory controller was not enabled
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return false, err
+			}
+			return count > 0, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *cgroup) remove() {
+	err := os.Remove(c.path)
+	if err != nil {
+		log.Printf("Warning: could not remove cgroup %s: %s", c.path, err)
+	}
+}
@@ -0,0 +1,25 @@
+package shepherd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCgroupPath(t *testing.T) {
+	p, err := parseCgroupPath("0::/user.slice/user-1000.slice/session-2.scope\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "/user.slice/user-1000.slice/session-2.scope", p)
+
+	p, err = parseCgroupPath("4:memory:/job\n1:name=systemd:/\n0::/\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "/", p)
+
+	_, err = parseCgroupPath("4:memory:/job\n")
+	assert.NotNil(t, err)
+}
+
+func TestFormatCPUMax(t *testing.T) {
+	assert.Equal(t, "150000 100000", formatCPUMax(1.5))
+	assert.Equal(t, "1000 100000", formatCPUMax(0.001))
+}
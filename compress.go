@@ -0,0 +1,63 @@
+package shepherd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Values for Download.Decompress and UploadPatterns.Compress. They double as
+// the Content-Encoding of compressed uploads.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+func validateCompression(format string) error {
+	switch format {
+	case "", CompressionGzip, CompressionZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, expected %q or %q", format, CompressionGzip, CompressionZstd)
+}
+
+// newDecompressor returns a reader of the decompressed content of r
+func newDecompressor(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", format)
+}
+
+// newCompressor returns a writer which compresses everything written to it
+// into w. It must be closed to flush the compressed stream, which leaves w open.
+func newCompressor(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q", format)
+}
+
+// contentType guesses the type of a file from its extension, so that
+// compressed uploads describe their decompressed content
+func contentType(filename string) string {
+	t := mime.TypeByExtension(path.Ext(filename))
+	if t == "" {
+		return "application/octet-stream"
+	}
+	return t
+}
@@ -0,0 +1,73 @@
+package shepherd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, content string, format string) string {
+	var buf bytes.Buffer
+	w, err := newCompressor(&buf, format)
+	require.Nil(t, err)
+	_, err = w.Write([]byte(content))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	return buf.String()
+}
+
+func decompress(t *testing.T, content string, format string) string {
+	r, err := newDecompressor(bytes.NewReader([]byte(content)), format)
+	require.Nil(t, err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	return string(b)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, format := range []string{CompressionGzip, CompressionZstd} {
+		compressed := compress(t, "hello world", format)
+		assert.NotEqual(t, "hello world", compressed)
+		assert.Equal(t, "hello world", decompress(t, compressed, format))
+	}
+}
+
+func TestTransparentCompression(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		UploadRules: []*UploadPatterns{
+			{Filters: []*Filter{{Pattern: "*.txt"}}, DestinationURLPrefix: "gs://mock/out", Compress: CompressionZstd},
+			{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://mock/out"},
+		},
+		Downloads: []*Download{{SourceURL: "gs://mock/in.txt.gz",
+			DestinationPath: "in.txt",
+			Decompress:      CompressionGzip}},
+		Command: []string{"bash", "-c", "tr a-z A-Z < in.txt > out.txt && cp out.txt out.csv"}}
+
+	localizer := NewMockLocalizer(workDir)
+	localizer.urlToContent["gs://mock/in.txt.gz"] = compress(t, "input", CompressionGzip)
+	uploader := NewMockUploader(workDir)
+
+	err = Execute(workDir, workDir, params, localizer, uploader)
+	require.Nil(t, err)
+
+	outputs := uploadedOutputs(t, uploader)
+	assert.Equal(t, "INPUT", decompress(t, outputs["gs://mock/out/out.txt"], CompressionZstd))
+	assert.Equal(t, "INPUT", outputs["gs://mock/out/out.csv"])
+}
+
+func TestValidateCompression(t *testing.T) {
+	assert.NotNil(t, validateCompression("bzip2"))
+	assert.NotNil(t, validateParameters(&Parameters{Command: []string{"true"},
+		Downloads: []*Download{{SourceURL: "gs://bucket/a.tar.gz", DestinationPath: "a", Extract: true, Decompress: CompressionGzip}}}))
+	assert.NotNil(t, validateParameters(&Parameters{Command: []string{"true"},
+		UploadRules: []*UploadPatterns{{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://bucket", Compress: CompressionGzip, Archive: &Archive{Format: ArchiveFormatZip}}}}))
+}
@@ -0,0 +1,79 @@
+package shepherd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+)
+
+// DownloadSizer is implemented by localizers which can tell how many bytes
+// each download will take up in the work directory before fetching it
+type DownloadSizer interface {
+	DownloadSizes(downloads []*Download) ([]int64, error)
+}
+
+// DiskSpace compares the space a job needs with what was free before its
+// downloads started. Compressed downloads are counted at their stored size,
+// so the space they need is underestimated.
+type DiskSpace struct {
+	DownloadBytes  int64 `json:"download_bytes"`
+	HeadroomBytes  int64 `json:"headroom_bytes"`
+	RequiredBytes  int64 `json:"required_bytes"`
+	AvailableBytes int64 `json:"available_bytes"`
+}
+
+// checkDiskSpace makes sure the filesystem of workdir has room for the
+// downloads plus headroom bytes for outputs, recording the comparison in results
+func checkDiskSpace(workdir string, localized []*Download, headroom int64, localizer Localizer, results *Results) error {
+	sizer, ok := localizer.(DownloadSizer)
+	if !ok {
+		log.Printf("Skipping disk space check, as the size of downloads is unknown")
+		return nil
+	}
+
+	available, err := freeDiskSpace(existingAncestor(workdir))
+	if err != nil {
+		log.Printf("Skipping disk space check, as free space is unknown: %s", err)
+		return nil
+	}
+
+	sizes, err := sizer.DownloadSizes(localized)
+	if err != nil {
+		return err
+	}
+
+	space := &DiskSpace{HeadroomBytes: headroom, AvailableBytes: available}
+	for _, size := range sizes {
+		space.DownloadBytes = addBytes(space.DownloadBytes, size)
+	}
+	space.RequiredBytes = addBytes(space.DownloadBytes, space.HeadroomBytes)
+	results.DiskSpace = space
+
+	if space.RequiredBytes > space.AvailableBytes {
+		return fmt.Errorf("not enough disk space for %s: %d bytes required (%d to download and %d headroom) but only %d available",
+			workdir, space.RequiredBytes, space.DownloadBytes, space.HeadroomBytes, space.AvailableBytes)
+	}
+	log.Printf("%d bytes required in %s and %d available", space.RequiredBytes, workdir, space.AvailableBytes)
+	return nil
+}
+
+// addBytes adds a non-negative number of bytes to n, saturating rather than
+// overflowing
+func addBytes(n int64, bytes int64) int64 {
+	if n > math.MaxInt64-bytes {
+		return math.MaxInt64
+	}
+	return n + bytes
+}
+
+// existingAncestor returns dir or the closest of its parents which exists
+func existingAncestor(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == "/" || dir == "." {
+			return dir
+		}
+		dir = path.Dir(dir)
+	}
+}
@@ -0,0 +1,96 @@
+package shepherd
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsufficientDiskSpace(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Downloads:         []*Download{{SourceURL: "gs://mock/1", DestinationPath: "1"}},
+		DiskHeadroomBytes: 1 << 62,
+		Command:           []string{"touch", "ran"}}
+
+	localizer := NewMockLocalizer(workDir)
+	localizer.urlToContent["gs://mock/1"] = "one"
+	uploader := NewMockUploader(workDir)
+
+	results, err := ExecuteResults(context.Background(), workDir, workDir, params, localizer, uploader)
+	require.NotNil(t, err)
+	assert.Equal(t, StatusInsufficientDiskSpace, results.Status)
+	require.NotNil(t, results.DiskSpace)
+	assert.Equal(t, int64(3), results.DiskSpace.DownloadBytes)
+	assert.Equal(t, int64(3+1<<62), results.DiskSpace.RequiredBytes)
+	assert.True(t, results.DiskSpace.AvailableBytes > 0)
+
+	// failed before downloading anything
+	assert.False(t, localizer.WasLocalized("1"))
+	_, err = os.Stat(path.Join(workDir, "ran"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskSpaceOverflow(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	localizer := NewMockLocalizer(workDir)
+	localizer.urlToContent["gs://mock/1"] = "one"
+	downloads := []*Download{{SourceURL: "gs://mock/1", DestinationPath: "1"}}
+
+	results := &Results{}
+	err = checkDiskSpace(workDir, downloads, math.MaxInt64, localizer, results)
+	require.NotNil(t, err)
+	assert.Equal(t, int64(math.MaxInt64), results.DiskSpace.RequiredBytes)
+}
+
+func TestDiskSpaceLookupFailed(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	// the size of a missing download can't be looked up
+	params := &Parameters{
+		Downloads: []*Download{{SourceURL: "gs://mock/missing", DestinationPath: "1"}},
+		Command:   []string{"true"}}
+
+	localizer := NewMockLocalizer(workDir)
+	uploader := NewMockUploader(workDir)
+
+	results, err := ExecuteResults(context.Background(), workDir, workDir, params, localizer, uploader)
+	require.NotNil(t, err)
+	assert.Equal(t, StatusLocalizationFailed, results.Status)
+	assert.Nil(t, results.DiskSpace)
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	localizer := NewMockLocalizer(workDir)
+	localizer.urlToContent["gs://mock/data.tar.gz"] = "archive"
+	localizer.urlToContent["gs://mock/plain"] = "plain"
+	downloads := []*Download{
+		{SourceURL: "gs://mock/data.tar.gz", DestinationPath: "data", Extract: true},
+		{SourceURL: "gs://mock/plain", DestinationPath: "plain"}}
+	localized, _ := planExtractions(downloads)
+
+	results := &Results{}
+	// the work directory doesn't need to exist yet
+	err = checkDiskSpace(path.Join(workDir, "not", "yet"), localized, 100, localizer, results)
+	require.Nil(t, err)
+	assert.Equal(t, int64(len("archive")+len("plain")), results.DiskSpace.DownloadBytes)
+	assert.Equal(t, results.DiskSpace.DownloadBytes+100, results.DiskSpace.RequiredBytes)
+}
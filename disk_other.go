@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package shepherd
+
+import "errors"
+
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.New("free disk space can only be determined on linux")
+}
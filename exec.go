@@ -1,53 +1,125 @@
 package shepherd
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-type Results struct {
-	ExitCode int `json:"exit_code"`
-}
-
 type Download struct {
 	SourceURL       string `json:"source_url"`
 	DestinationPath string `json:"destination_path"`
 	Executable      bool   `json:"executable"`
 	SymlinkSafe     bool   `json:"symlink_safe"`
+	UploadPolicy    string `json:"upload_policy"`
+	// Extract unpacks the downloaded .tar, .tar.gz, .tar.zst or .zip archive
+	// into DestinationPath, which becomes a directory
+	Extract bool `json:"extract"`
+	// Decompress is the compression (CompressionGzip or CompressionZstd) to
+	// undo while downloading
+	Decompress string `json:"decompress"`
 }
 
 type Upload struct {
-	SourcePath     string
-	DestinationURL string
+	SourcePath     string `json:"source_path"`
+	DestinationURL string `json:"destination_url"`
+	// SymlinkTarget, if set, is recorded in the object's metadata instead of uploading the content of SourcePath
+	SymlinkTarget string `json:"symlink_target,omitempty"`
+	// ContentEncoding, if set, is the compression applied while uploading
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	// Metadata holds the attributes to write along with the object
+	Metadata *ObjectMetadata `json:"-"`
+	// Size, MD5 and Generation are filled in by the Uploader once the upload completes
+	Size       int64  `json:"size"`
+	MD5        string `json:"md5"`
+	Generation int64  `json:"generation"`
 }
 
+// Filter selects which files are uploaded. Patterns follow gitignore syntax:
+//
+//   - "*" matches anything except "/", "?" matches any single character other
+//     than "/" and "[a-z]" matches a character class ("[!a-z]" negates it)
+//   - "**/" matches zero or more directories, so "results/**/*.csv" matches
+//     csv files at any depth within results. A trailing "/**" matches
+//     everything within a directory.
+//   - a pattern containing a "/" (other than a trailing one) is anchored to the
+//     work directory, otherwise it matches a file or directory at any depth
+//   - a trailing "/" only matches directories
+//   - a leading "!" negates the pattern, flipping the effect of the filter
+//
+// A pattern which matches a directory also matches everything within it.
+// Filters are applied in order and the last one to match a file decides
+// whether it is included, with files that match no filter being excluded.
+// Directories which are excluded are not descended into, so files within them
+// cannot be re-included by a later filter.
+//
+// Besides Pattern, a filter may also specify a Regex (matched against the path
+// relative to the work directory, use ^ and $ to anchor it) and predicates on
+// the size, type and modification time of the file. A filter only matches a
+// file when all of the criteria it specifies hold. Filters with a Regex or any
+// predicate only apply to files, never to directories.
 type Filter struct {
-	Pattern string `json:"pattern"`
-	Exclude bool   `json:"exclude"`
+	Pattern        string     `json:"pattern"`
+	Regex          string     `json:"regex"`
+	MinSize        *int64     `json:"min_size"`
+	MaxSize        *int64     `json:"max_size"`
+	Type           string     `json:"type"`
+	ModifiedAfter  *time.Time `json:"modified_after"`
+	ModifiedBefore *time.Time `json:"modified_before"`
+	Exclude        bool       `json:"exclude"`
 }
 
+// UploadPatterns is a rule which uploads the outputs selected by Filters to
+// DestinationURLPrefix. Before being appended to the prefix, the path of each
+// file can be rewritten by removing its first StripComponents directories and
+// then applying the Rename template (see renameData for the fields available).
+//
+// When a job has several rules, each output is uploaded by the first rule
+// whose filters include it. SymlinkPolicy controls how symlinks among the
+// outputs are handled (see SymlinkPolicyFollow and friends). If Archive is
+// set, the selected files are bundled into a single archive rather than
+// uploaded individually. Otherwise, Compress compresses each file as it is
+// uploaded, recording the compression as the object's Content-Encoding.
+// Metadata sets the attributes of the uploaded objects.
 type UploadPatterns struct {
-	Filters              []*Filter `json:"filters"`
-	DestinationURLPrefix string    `json:"destination_url_prefix"`
+	Filters              []*Filter       `json:"filters"`
+	DestinationURLPrefix string          `json:"destination_url_prefix"`
+	StripComponents      int             `json:"strip_components"`
+	Rename               string          `json:"rename"`
+	SymlinkPolicy        string          `json:"symlink_policy"`
+	Archive              *Archive        `json:"archive"`
+	Compress             string          `json:"compress"`
+	Metadata             *ObjectMetadata `json:"metadata"`
 }
 
 type Parameters struct {
-	Uploads     *UploadPatterns `json:"uploads"`
-	Downloads   []*Download     `json:"downloads"`
-	DockerImage string          `json:"docker_image"`
-	Command     []string        `json:"command"`
-	WorkingPath string          `json:"working_path"`
-	ResultPath  string          `json:"result_path"`
-	StdoutPath  string          `json:"stdout_path"`
-	StderrPath  string          `json:"stderr_path"`
+	// JobID is recorded in the metadata of every uploaded object
+	JobID             string            `json:"job_id"`
+	Uploads           *UploadPatterns   `json:"uploads"`
+	UploadRules       []*UploadPatterns `json:"upload_rules"`
+	Downloads         []*Download       `json:"downloads"`
+	InputUploadPolicy string            `json:"input_upload_policy"`
+	DockerImage       string            `json:"docker_image"`
+	Sandbox           *Sandbox          `json:"sandbox"`
+	Resources         *ResourceLimits   `json:"resources"`
+	// DiskHeadroomBytes is the space to leave free for outputs, on top of
+	// the downloads, for the job to be started
+	DiskHeadroomBytes int64           `json:"disk_headroom_bytes"`
+	Command           []string        `json:"command"`
+	WorkingPath       string          `json:"working_path"`
+	ResultPath        string          `json:"result_path"`
+	StdoutPath        string          `json:"stdout_path"`
+	StderrPath        string          `json:"stderr_path"`
+	TimeoutSeconds    int             `json:"timeout_seconds"`
+	Retry             *Retry          `json:"retry"`
+	OnFailure         *FailureUploads `json:"on_failure"`
 	// PreDownloadScript  string            `json:"pre-download-script,omitempty"`
 	// PostDownloadScript string            `json:"post-download-script,omitempty"`
 	// PostExecScript     string            `json:"post-exec-script,omitempty"`
@@ -74,66 +146,136 @@ func validatePath(path string) error {
 }
 
 func validateParameters(params *Parameters) error {
-	var err error
+	v := &validator{}
 
 	if len(params.Command) == 0 {
-		return errors.New("empty command")
+		v.check("command", errors.New("empty command"))
 	}
 
-	if err == nil {
-		if params.Uploads != nil {
-			err = validateURL(params.Uploads.DestinationURLPrefix)
+	if params.Uploads != nil {
+		validateUploadRule(v, "uploads", params.Uploads)
+	}
+	for i, rule := range params.UploadRules {
+		field := fmt.Sprintf("upload_rules[%d]", i)
+		if rule == nil {
+			v.check(field, errNull)
+			continue
 		}
+		validateUploadRule(v, field, rule)
 	}
 
-	for _, download := range params.Downloads {
-		if err == nil {
-			err = validateURL(download.SourceURL)
+	v.check("input_upload_policy", validateUploadPolicy(params.InputUploadPolicy))
+
+	for i, download := range params.Downloads {
+		field := fmt.Sprintf("downloads[%d]", i)
+		if download == nil {
+			v.check(field, errNull)
+			continue
+		}
+		v.check(field+".source_url", validateURL(download.SourceURL))
+		v.check(field+".destination_path", validatePath(download.DestinationPath))
+		v.check(field+".upload_policy", validateUploadPolicy(download.UploadPolicy))
+		if download.Extract {
+			_, err := extractFormat(download.SourceURL)
+			v.check(field+".extract", err)
 		}
-		if err == nil {
-			err = validatePath(download.DestinationPath)
+		v.check(field+".decompress", validateCompression(download.Decompress))
+		if download.Decompress != "" && download.Extract {
+			v.check(field+".decompress", errors.New("cannot both extract and decompress a download"))
+		}
+		if download.Decompress != "" && download.SymlinkSafe {
+			v.check(field+".decompress", errors.New("cannot both symlink and decompress a download"))
 		}
 	}
 
-	if err == nil {
-		if params.WorkingPath != "" {
-			err = validatePath(params.WorkingPath)
-		}
+	if params.Sandbox != nil && params.DockerImage != "" {
+		v.check("sandbox", errors.New("sandbox only applies to host commands and cannot be combined with docker_image"))
 	}
 
-	if err == nil {
-		if params.StdoutPath != "" {
-			err = validatePath(params.StdoutPath)
-		}
+	if params.Resources != nil {
+		validateResourceLimits(v, "resources", params.Resources)
 	}
-	if err == nil {
-		if params.StderrPath != "" {
-			err = validatePath(params.StderrPath)
-		}
+
+	if params.DiskHeadroomBytes < 0 {
+		v.check("disk_headroom_bytes", fmt.Errorf("must not be negative but was %d", params.DiskHeadroomBytes))
 	}
-	if err == nil {
-		if params.ResultPath != "" {
-			err = validatePath(params.ResultPath)
-		}
+
+	if params.TimeoutSeconds < 0 {
+		v.check("timeout_seconds", fmt.Errorf("must not be negative but was %d", params.TimeoutSeconds))
 	}
 
-	return err
+	if params.Retry != nil {
+		validateRetry(v, "retry", params.Retry)
+	}
+
+	if params.OnFailure != nil {
+		validateFailureUploads(v, "on_failure", params.OnFailure)
+	}
+
+	if params.WorkingPath != "" {
+		v.check("working_path", validatePath(params.WorkingPath))
+	}
+	if params.StdoutPath != "" {
+		v.check("stdout_path", validatePath(params.StdoutPath))
+	}
+	if params.StderrPath != "" {
+		v.check("stderr_path", validatePath(params.StderrPath))
+	}
+	if params.ResultPath != "" {
+		v.check("result_path", validatePath(params.ResultPath))
+	}
+
+	return v.err()
+}
+
+func validateUploadRule(v *validator, field string, rule *UploadPatterns) {
+	v.check(field+".destination_url_prefix", validateURL(rule.DestinationURLPrefix))
+	for i, filter := range rule.Filters {
+		filterField := fmt.Sprintf("%s.filters[%d]", field, i)
+		if filter == nil {
+			v.check(filterField, errNull)
+			continue
+		}
+		_, err := compileFilter(filter)
+		if fieldErr, ok := err.(*FieldError); ok {
+			v.check(filterField+"."+fieldErr.Field, fieldErr.Err)
+		} else {
+			v.check(filterField, err)
+		}
+	}
+	if rule.StripComponents < 0 {
+		v.check(field+".strip_components", fmt.Errorf("must not be negative but was %d", rule.StripComponents))
+	} else {
+		_, err := newPathRewriter(rule)
+		v.check(field+".rename", err)
+	}
+	v.check(field+".symlink_policy", validateSymlinkPolicy(rule.SymlinkPolicy))
+	if rule.Archive != nil {
+		v.check(field+".archive", validateArchive(rule.Archive))
+	}
+	v.check(field+".compress", validateCompression(rule.Compress))
+	if rule.Compress != "" && rule.Archive != nil {
+		v.check(field+".compress", errors.New("archives are already compressed, so compress cannot be combined with archive"))
+	}
+	if rule.Metadata != nil {
+		v.check(field+".metadata", validateObjectMetadata(rule.Metadata))
+	}
 }
 
-func prepareCommand(workdir string, command []string, WorkingPath string, StdoutPath string, StderrPath string) (*exec.Cmd, error) {
+// prepareCommand sets up the command of an attempt, whose output is appended
+// to the logs of earlier attempts. The returned files must be closed once the
+// command has exited.
+func prepareCommand(workdir string, command []string, WorkingPath string, StdoutPath string, StderrPath string, attemptNumber int) (*exec.Cmd, []*os.File, error) {
 	cmd := exec.Command(command[0], command[1:]...)
 	cmd.Dir = WorkingPath
 
+	var files []*os.File
 	if StdoutPath != "" {
-		p := path.Join(workdir, StdoutPath)
-		err := ensureParentDirExists(p)
+		stdout, err := openLog(path.Join(workdir, StdoutPath), attemptNumber)
 		if err != nil {
-			return nil, err
-		}
-		stdout, err := os.Create(p)
-		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		files = append(files, stdout)
 		cmd.Stdout = stdout
 	} else {
 		cmd.Stdout = os.Stdout
@@ -143,62 +285,157 @@ func prepareCommand(workdir string, command []string, WorkingPath string, Stdout
 		if StderrPath == StdoutPath {
 			cmd.Stderr = cmd.Stdout
 		} else {
-			p := path.Join(workdir, StderrPath)
-			err := ensureParentDirExists(p)
+			stderr, err := openLog(path.Join(workdir, StderrPath), attemptNumber)
 			if err != nil {
-				return nil, err
-			}
-
-			stderr, err := os.Create(p)
-			if err != nil {
-				return nil, err
+				closeFiles(files)
+				return nil, nil, err
 			}
+			files = append(files, stderr)
 			cmd.Stderr = stderr
 		}
 	} else {
 		cmd.Stderr = os.Stderr
 	}
 
-	return cmd, nil
+	return cmd, files, nil
 }
 
-func writeResult(resultPath string, state *os.ProcessState) error {
-	err := ensureParentDirExists(resultPath)
+// openLog opens a log for appending, marking where a retry's output starts
+func openLog(p string, attemptNumber int) (*os.File, error) {
+	err := ensureParentDirExists(p)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	results := Results{ExitCode: state.ExitCode()}
-	b, err := json.Marshal(&results)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	err = ioutil.WriteFile(resultPath, b, os.ModePerm)
-	if err != nil {
-		return err
+	if attemptNumber > 1 {
+		_, err = fmt.Fprintf(f, "--- shepherd: attempt %d ---\n", attemptNumber)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
 	}
+	return f, nil
+}
 
-	return nil
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		err := f.Close()
+		if err != nil {
+			log.Printf("Warning: Could not close %s: %s", f.Name(), err)
+		}
+	}
 }
 
 const DockerWorkRoot = "/mnt/shepherd"
 
+// Execute localizes the inputs, runs the command and uploads its outputs. The
+// returned error only reflects problems within shepherd itself; a command
+// which exits with a non-zero exit code is recorded in the results file.
 func Execute(workRoot string, workdir string, params *Parameters, localizer Localizer, uploader Uploader) error {
+	return ExecuteContext(context.Background(), workRoot, workdir, params, localizer, uploader)
+}
+
+// ExecuteContext is like Execute but kills the command if ctx is cancelled
+// before it completes.
+func ExecuteContext(ctx context.Context, workRoot string, workdir string, params *Parameters, localizer Localizer, uploader Uploader) error {
+	_, err := ExecuteResults(ctx, workRoot, workdir, params, localizer, uploader)
+	return err
+}
+
+// ExecuteResults is like ExecuteContext but also returns the results of the
+// job, which describe how far it got even if an error is returned.
+func ExecuteResults(ctx context.Context, workRoot string, workdir string, params *Parameters, localizer Localizer, uploader Uploader) (*Results, error) {
+	return ExecutePreemptible(ctx, workRoot, workdir, params, localizer, uploader, nil)
+}
+
+// ExecutePreemptible is like ExecuteResults but stops the job early if
+// preemption is triggered, in which case only the logs are uploaded.
+func ExecutePreemptible(ctx context.Context, workRoot string, workdir string, params *Parameters, localizer Localizer, uploader Uploader, preemption *Preemption) (*Results, error) {
+	results := &Results{Attempt: Attempt{ExitCode: -1}}
+	err := execute(ctx, workRoot, workdir, params, localizer, uploader, preemption, results)
+	if err != nil {
+		// make sure there's a record of what went wrong, even if we never got as far as running the command
+		if results.Status == "" {
+			results.Status = StatusInternalError
+		}
+		results.Error = err.Error()
+		if params.ResultPath != "" && validatePath(params.ResultPath) == nil {
+			writeErr := writeResult(path.Join(workdir, params.ResultPath), results)
+			if writeErr != nil {
+				log.Printf("Warning: Could not write results to %s: %s", params.ResultPath, writeErr)
+			} else if results.Status == StatusUploadFailed {
+				// any results uploaded along with the outputs predate the failure
+				uploadResultFile(workdir, params, uploader)
+			}
+		}
+	}
+	return results, err
+}
+
+// uploadResultFile makes a best effort to upload the result file on its own
+// to the destination of the logs
+func uploadResultFile(workdir string, params *Parameters, uploader Uploader) {
+	prefix := params.logDestinationPrefix()
+	if prefix == "" {
+		return
+	}
+	uploadRec := &Upload{SourcePath: params.ResultPath, DestinationURL: joinURL(prefix, params.ResultPath)}
+	uploadRec.Metadata = (*ObjectMetadata)(nil).forUpload(uploadRec, jobMetadata(params))
+	err := uploader.Upload([]*Upload{uploadRec})
+	if err != nil {
+		log.Printf("Warning: Could not upload results to %s: %s", uploadRec.DestinationURL, err)
+	}
+}
+
+func execute(ctx context.Context, workRoot string, workdir string, params *Parameters, localizer Localizer, uploader Uploader, preemption *Preemption, results *Results) error {
 	log.Printf("Validating parameters...")
 	err := validateParameters(params)
 	if err != nil {
+		results.Status = StatusInvalidParameters
+		return err
+	}
+
+	downloads, extractions := planExtractions(params.Downloads)
+
+	err = checkDiskSpace(workdir, downloads, params.DiskHeadroomBytes, localizer, results)
+	if err != nil {
+		// otherwise the sizes of the downloads couldn't be looked up
+		if space := results.DiskSpace; space != nil && space.RequiredBytes > space.AvailableBytes {
+			results.Status = StatusInsufficientDiskSpace
+		} else {
+			results.Status = StatusLocalizationFailed
+		}
 		return err
 	}
 
-	log.Printf("Preparing %s with %d files in GCS...", workdir, len(params.Downloads))
-	err = localizer.Prepare(params.Downloads)
+	// nothing has been downloaded yet, so there's only the result to upload
+	if preemption.isPreempted() {
+		return finishPreempted(workdir, params, localizer, uploader, preemption, results)
+	}
+
+	log.Printf("Preparing %s with %d files in GCS...", workdir, len(downloads))
+	err = localizer.Prepare(downloads)
 	if err != nil {
+		results.Status = StatusLocalizationFailed
 		return err
 	}
 
 	defer localizer.Clean()
 
+	inputs, err := newInputTracker(workdir, downloads, params.InputUploadPolicy, localizer)
+	if err != nil {
+		return err
+	}
+
+	err = extractDownloads(workdir, extractions, inputs)
+	if err != nil {
+		results.Status = StatusLocalizationFailed
+		return err
+	}
+
 	var fullWorkPath string
 	if params.WorkingPath == "" {
 		fullWorkPath = workdir
@@ -210,7 +447,96 @@ func Execute(workRoot string, workdir string, params *Parameters, localizer Loca
 		return err
 	}
 
+	var existingFiles map[string]bool
+	if params.Retry != nil && params.Retry.CleanOutputs {
+		existingFiles, err = listExistingFiles(workdir, inputs)
+		if err != nil {
+			return err
+		}
+		// the logs of every attempt are kept, along with their directories
+		for _, p := range []string{params.StdoutPath, params.StderrPath} {
+			for ; p != "" && p != "."; p = path.Dir(p) {
+				existingFiles[p] = true
+			}
+		}
+	}
+
+	// retries are abandoned as soon as the job is preempted
+	retryCtx, cancelRetries := preemption.context(ctx)
+	defer cancelRetries()
+
+	for attemptNumber := 1; !preemption.isPreempted(); attemptNumber++ {
+		attempt, err := runCommand(ctx, workRoot, workdir, fullWorkPath, params, attemptNumber, preemption)
+		if err != nil {
+			return err
+		}
+		results.Attempts = append(results.Attempts, attempt)
+		results.Attempt = *attempt
+
+		if !shouldRetry(params.Retry, attempt, attemptNumber) {
+			break
+		}
+
+		delay := retryDelay(params.Retry, attemptNumber)
+		log.Printf("Attempt %d of %d failed with exit code %d, retrying in %s", attemptNumber, params.Retry.MaxAttempts, attempt.ExitCode, delay)
+		if !sleepContext(retryCtx, delay) {
+			results.Cancelled = ctx.Err() != nil
+			break
+		}
+
+		if params.Retry.CleanOutputs {
+			err = cleanOutputs(workdir, existingFiles, inputs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if params.Resources != nil {
+		results.MemoryLimit = params.Resources.MemoryBytes
+		results.CPULimit = params.Resources.CPUs
+	}
+
+	// a command which succeeded, even if only just as the signal arrived,
+	// keeps its outputs, but otherwise only the logs are uploaded
+	completed := len(results.Attempts) > 0 && results.ExitCode == 0
+	if preemption.isPreempted() && !completed {
+		return finishPreempted(workdir, params, inputs, uploader, preemption, results)
+	}
+
+	if results.ExitCode == 0 {
+		results.Status = StatusSuccess
+	} else {
+		results.Status = StatusCommandFailed
+	}
+
+	log.Printf("Command completed, writing exit code (%d) to %s", results.ExitCode, params.ResultPath)
+	if params.ResultPath != "" {
+		err = writeResult(path.Join(workdir, params.ResultPath), results)
+		if err != nil {
+			return err
+		}
+	}
+
+	rules := params.uploadRules()
+	if results.Status != StatusSuccess && params.OnFailure != nil {
+		log.Printf("Command failed, applying failure upload policy %q", params.OnFailure.Policy)
+		rules = params.failureUploadRules()
+	}
+
+	err = uploadResults(workdir, rules, params.Downloads, jobMetadata(params), inputs, uploader)
+	if err != nil {
+		results.Status = StatusUploadFailed
+		return err
+	}
+
+	return nil
+}
+
+// runCommand runs the command once and reports how it exited
+func runCommand(ctx context.Context, workRoot string, workdir string, fullWorkPath string, params *Parameters, attemptNumber int, preemption *Preemption) (*Attempt, error) {
 	command := params.Command
+	var dockerContainerName string
 	if params.DockerImage != "" {
 		relWorkDir, err := filepath.Rel(workRoot, fullWorkPath)
 		if err != nil {
@@ -221,71 +547,210 @@ func Execute(workRoot string, workdir string, params *Parameters, localizer Loca
 		if err != nil {
 			panic(err)
 		}
-		command = append([]string{"docker", "run", "-v", absWorkRoot + ":" + DockerWorkRoot, "-w", dockerWorkDir, "--interactive", "--rm", params.DockerImage}, command...)
+		// name the container so that we can find it again to kill it or inspect it
+		dockerContainerName = newDockerContainerName()
+		dockerCommand := []string{"docker", "run", "-v", absWorkRoot + ":" + DockerWorkRoot, "-w", dockerWorkDir, "--interactive", "--name", dockerContainerName}
+		if params.Resources != nil {
+			// keep the container around after it exits so we can ask docker whether it was OOM killed,
+			// removing it however we return
+			dockerCommand = append(dockerCommand, dockerResourceArgs(params.Resources)...)
+			defer removeDockerContainer(dockerContainerName)
+		} else {
+			dockerCommand = append(dockerCommand, "--rm")
+		}
+		command = append(append(dockerCommand, params.DockerImage), command...)
 	}
 
-	cmd, err := prepareCommand(workdir, command, fullWorkPath, params.StdoutPath, params.StderrPath)
+	cmd, logs, err := prepareCommand(workdir, command, fullWorkPath, params.StdoutPath, params.StderrPath, attemptNumber)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer closeFiles(logs)
+
+	var cg *cgroup
+	if params.DockerImage == "" && (params.Sandbox != nil || params.Resources != nil) {
+		cg, err = isolateHostCommand(cmd, workdir, params.Sandbox, params.Resources)
+		if err != nil {
+			return nil, err
+		}
+		if cg != nil {
+			defer cg.remove()
+		}
 	}
 
 	log.Printf("With working dir %s, running command: %v", cmd.Dir, cmd.Args)
 	err = cmd.Start()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	attempt := &Attempt{}
 	log.Printf("Waiting for command to complete")
-	err = cmd.Wait()
+	err = waitForCommand(ctx, cmd, time.Duration(params.TimeoutSeconds)*time.Second, dockerContainerName, preemption, attempt)
 	if _, isExitError := err.(*exec.ExitError); isExitError {
 		log.Printf("Exited with failure: %s", err)
 	} else if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Printf("Command completed, writing exit code (%d) to %s", cmd.ProcessState.ExitCode(), params.ResultPath)
-	if params.ResultPath != "" {
-		err = writeResult(path.Join(workdir, params.ResultPath), cmd.ProcessState)
-		if err != nil {
-			return err
+	attempt.ExitCode = cmd.ProcessState.ExitCode()
+	attempt.Signal, attempt.SignalName = terminatingSignal(cmd.ProcessState)
+	if params.Resources != nil {
+		attempt.OOMKilled = checkOOMKilled(cg, dockerContainerName)
+		if attempt.OOMKilled {
+			log.Printf("Command was killed after exceeding memory limit of %d bytes", params.Resources.MemoryBytes)
 		}
 	}
 
-	err = uploadResults(workdir, params.Uploads, localizer, uploader)
-	if err != nil {
+	return attempt, nil
+}
+
+// waitForCommand waits for cmd to exit, killing it if the timeout elapses or
+// ctx is cancelled first. If preempted, the signals are forwarded to it and
+// it's only killed if it hasn't exited in time.
+func waitForCommand(ctx context.Context, cmd *exec.Cmd, timeout time.Duration, dockerContainerName string, preemption *Preemption, attempt *Attempt) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	select {
+	case err := <-done:
 		return err
+	case <-timeoutC:
+		log.Printf("Command did not complete within %s, killing it", timeout)
+		attempt.TimedOut = true
+	case <-ctx.Done():
+		log.Printf("Cancelled, killing command")
+		attempt.Cancelled = true
+	case sig := <-preemption.signalC():
+		// the command may have exited just as the signal arrived
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		attempt.Preempted = true
+		signalCommand(cmd, dockerContainerName, sig)
+
+		killTimer := time.NewTimer(preemption.killAfter())
+		defer killTimer.Stop()
+		for {
+			select {
+			case err := <-done:
+				return err
+			case sig := <-preemption.signalC():
+				signalCommand(cmd, dockerContainerName, sig)
+				continue
+			case <-killTimer.C:
+				log.Printf("Command did not exit within %s of being preempted, killing it", preemption.Deadline/2)
+			}
+			break
+		}
 	}
 
-	return nil
+	killCommand(cmd, dockerContainerName)
+	return <-done
 }
 
-func matchesInclusionPattern(name string, filters []*Filter) bool {
-	exclude := true
-	baseName := path.Base(name)
-	for _, filter := range filters {
-		fullNameMatched, _ := filepath.Match(filter.Pattern, name)
-		baseNameMatched, _ := filepath.Match(filter.Pattern, baseName)
-		if fullNameMatched || baseNameMatched {
-			exclude = filter.Exclude
+// signalCommand forwards sig to the command, or the container it runs in
+func signalCommand(cmd *exec.Cmd, dockerContainerName string, sig os.Signal) {
+	log.Printf("Forwarding %s to command", sig)
+	if dockerContainerName != "" {
+		// the docker client would also forward it, but might not have
+		// started the container yet
+		signalDockerContainer(dockerContainerName, sig)
+		return
+	}
+	err := cmd.Process.Signal(sig)
+	if err != nil {
+		log.Printf("Warning: Could not send %s to process %d: %s", sig, cmd.Process.Pid, err)
+	}
+}
+
+// finishPreempted records that the job was preempted and uploads its logs
+// and results. It's up to the caller to give up once the deadline expires.
+func finishPreempted(workdir string, params *Parameters, localizer HasLocalizedCheck, uploader Uploader, preemption *Preemption, results *Results) error {
+	err := fmt.Errorf("preempted by %s", preemption.signal)
+	results.Status = StatusPreempted
+	results.Error = err.Error()
+
+	if params.ResultPath != "" {
+		writeErr := writeResult(path.Join(workdir, params.ResultPath), results)
+		if writeErr != nil {
+			log.Printf("Warning: Could not write results to %s: %s", params.ResultPath, writeErr)
 		}
 	}
-	return !exclude
+
+	log.Printf("Preempted, uploading logs")
+	uploadErr := uploadResults(workdir, params.logUploadRules(), params.Downloads, jobMetadata(params), localizer, uploader)
+	if uploadErr != nil {
+		log.Printf("Warning: Could not upload logs: %s", uploadErr)
+	}
+	return err
+}
+
+func killCommand(cmd *exec.Cmd, dockerContainerName string) {
+	if dockerContainerName != "" {
+		// killing the docker client does not stop the container
+		killDockerContainer(dockerContainerName)
+	}
+	err := cmd.Process.Kill()
+	if err != nil {
+		log.Printf("Warning: Could not kill process %d: %s", cmd.Process.Pid, err)
+	}
+}
+
+// checkOOMKilled determines whether the command was killed for exceeding its
+// memory limit. Failure to find out is not fatal as the command has already
+// completed, so it is only logged.
+func checkOOMKilled(cg *cgroup, dockerContainerName string) bool {
+	var oomKilled bool
+	var err error
+	if cg != nil {
+		oomKilled, err = cg.oomKilled()
+	} else if dockerContainerName != "" {
+		oomKilled, err = dockerOOMKilled(dockerContainerName)
+	}
+	if err != nil {
+		log.Printf("Warning: Could not determine whether command was OOM killed: %s", err)
+	}
+	return oomKilled
 }
 
 func findNewFiles(workdir string, filters []*Filter, localizer HasLocalizedCheck) ([]string, error) {
+	compiledFilters, err := compileFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+
 	filenames := make([]string, 0, 100)
-	err := filepath.Walk(workdir, func(_path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(workdir, func(_path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
 		relPath, err := filepath.Rel(workdir, _path)
 		if err != nil {
 			panic(err) // should not be possible
 		}
 
 		if info.IsDir() {
-			if matchesInclusionPattern(relPath, filters) {
-				return nil
-			} else {
+			if relPath == shepherdDir {
+				// holds shepherd's own files, not outputs of the command
 				return filepath.SkipDir
 			}
+			if relPath != "." && compiledFilters.prunes(relPath) {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
 		// log.Printf("checking localizer.WasLocalized(%s)", relPath)
@@ -295,7 +760,7 @@ func findNewFiles(workdir string, filters []*Filter, localizer HasLocalizedCheck
 		}
 		// log.Printf("false")
 
-		if matchesInclusionPattern(relPath, filters) {
+		if compiledFilters.includes(relPath, info) {
 			filenames = append(filenames, relPath)
 		}
 		return nil
@@ -303,27 +768,125 @@ func findNewFiles(workdir string, filters []*Filter, localizer HasLocalizedCheck
 	return filenames, err
 }
 
-func uploadResults(workdir string, uploadPatterns *UploadPatterns, localizer Localizer, uploader Uploader) error {
-	if uploadPatterns != nil {
-		filenames, err := findNewFiles(workdir, uploadPatterns.Filters, localizer)
+// uploadResults uploads the outputs selected by each rule, followed by the
+// manifest. job is the custom metadata recorded on every uploaded object.
+func uploadResults(workdir string, rules []*UploadPatterns, downloads []*Download, job map[string]string, localizer HasLocalizedCheck, uploader Uploader) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	// every rule's uploads are resolved before any are made, so a collision
+	// doesn't leave some of them uploaded
+	ruleUploads := make([][]*Upload, len(rules))
+	allUploads := make([]*Upload, 0, 100)
+	prefixes := make([]string, 0, len(rules))
+	seenPrefixes := make(map[string]bool)
+	claimed := make(map[string]bool)
+	destinations := make(map[string]string)
+	for i, rule := range rules {
+		if !seenPrefixes[rule.DestinationURLPrefix] {
+			seenPrefixes[rule.DestinationURLPrefix] = true
+			prefixes = append(prefixes, rule.DestinationURLPrefix)
+			destinations[joinURL(rule.DestinationURLPrefix, ManifestName)] = "the manifest"
+		}
+
+		selected, err := selectOutputs(workdir, rule, localizer, claimed)
 		if err != nil {
 			return err
 		}
-		uploads := make([]*Upload, len(filenames))
-		for i, filename := range filenames {
-			uploads[i] = &Upload{SourcePath: filename, DestinationURL: joinURL(uploadPatterns.DestinationURLPrefix, filename)}
+
+		var uploads []*Upload
+		if rule.Archive != nil {
+			uploads, err = archiveUploads(workdir, i, rule.DestinationURLPrefix, rule.Archive, selected)
+			if err != nil {
+				return err
+			}
+		} else {
+			uploads = make([]*Upload, len(selected))
+			for i, file := range selected {
+				uploads[i] = file.upload
+				if file.upload.SymlinkTarget == "" {
+					file.upload.ContentEncoding = rule.Compress
+				}
+			}
 		}
-		log.Printf("Uploading %d files to %s", len(uploads), uploadPatterns.DestinationURLPrefix)
-		err = uploader.Upload(uploads)
+
+		for _, uploadRec := range uploads {
+			uploadRec.Metadata = rule.Metadata.forUpload(uploadRec, job)
+			if other, exists := destinations[uploadRec.DestinationURL]; exists {
+				return fmt.Errorf("both %s and %s would be uploaded to %s", other, uploadRec.SourcePath, uploadRec.DestinationURL)
+			}
+			destinations[uploadRec.DestinationURL] = uploadRec.SourcePath
+		}
+		ruleUploads[i] = uploads
+		allUploads = append(allUploads, uploads...)
+	}
+
+	for i, rule := range rules {
+		log.Printf("Uploading %d files to %s", len(ruleUploads[i]), rule.DestinationURLPrefix)
+		err := uploader.Upload(ruleUploads[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, prefix := range prefixes {
+		err := uploadManifest(workdir, prefix, allUploads, downloads, job, uploader)
 		if err != nil {
 			return err
 		}
-		log.Printf("Upload completed")
 	}
+	log.Printf("Upload completed")
 
 	return nil
 }
 
+// selectedFile is a file selected by an upload rule, along with its path
+// relative to the rule's destination
+type selectedFile struct {
+	upload *Upload
+	path   string
+}
+
+// selectOutputs finds the files which the rule should upload and where they
+// should go. Files already present in claimed (because an earlier rule
+// selected them) are skipped, and the selected files are added to it.
+func selectOutputs(workdir string, rule *UploadPatterns, localizer HasLocalizedCheck, claimed map[string]bool) ([]*selectedFile, error) {
+	rewriter, err := newPathRewriter(rule)
+	if err != nil {
+		return nil, err
+	}
+	filenames, err := findNewFiles(workdir, rule.Filters, localizer)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]*selectedFile, 0, len(filenames))
+	for _, filename := range filenames {
+		if claimed[filename] {
+			// already uploaded by an earlier rule
+			continue
+		}
+		claimed[filename] = true
+
+		destPath, err := rewriter.rewrite(filename)
+		if err != nil {
+			return nil, err
+		}
+		uploadRec := &Upload{SourcePath: filename, DestinationURL: joinURL(rule.DestinationURLPrefix, destPath)}
+		include, err := applySymlinkPolicy(workdir, rule.SymlinkPolicy, uploadRec)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+
+		selected = append(selected, &selectedFile{upload: uploadRec, path: destPath})
+	}
+	return selected, nil
+}
+
 func joinURL(prefix string, suffix string) string {
 	if strings.HasPrefix(suffix, "/") {
 		panic(fmt.Sprintf("path %s should not start with /", suffix))
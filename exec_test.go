@@ -1,12 +1,21 @@
 package shepherd
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -71,7 +80,7 @@ func TestDocker(t *testing.T) {
 	assert.Equal(t, map[string]string{"gs://mock/2": "one",
 		"gs://mock/out.txt": "out\n",
 		"gs://mock/err.txt": "err\n"},
-		uploader.uploaded)
+		uploadedOutputs(t, uploader))
 
 }
 
@@ -89,12 +98,14 @@ func NewMockLocalizer(workDir string) *MockLocalizer {
 
 type MockUploader struct {
 	workDir  string
-	uploaded map[string]string // url -> content
+	uploaded map[string]string          // url -> content
+	metadata map[string]*ObjectMetadata // url -> metadata
 }
 
 func NewMockUploader(workDir string) *MockUploader {
 	return &MockUploader{workDir: workDir,
-		uploaded: make(map[string]string)}
+		uploaded: make(map[string]string),
+		metadata: make(map[string]*ObjectMetadata)}
 }
 
 func (m *MockLocalizer) WasLocalized(path string) bool {
@@ -107,10 +118,26 @@ func (m *MockLocalizer) Prepare(downloads []*Download) error {
 		if !exists {
 			panic(fmt.Errorf("Could not find %s", download.SourceURL))
 		}
-		f, err := os.Create(path.Join(m.workDir, download.DestinationPath))
+		dest := path.Join(m.workDir, download.DestinationPath)
+		err := ensureParentDirExists(dest)
 		if err != nil {
 			panic(err)
 		}
+		f, err := os.Create(dest)
+		if err != nil {
+			panic(err)
+		}
+		if download.Decompress != "" {
+			r, err := newDecompressor(strings.NewReader(content), download.Decompress)
+			if err != nil {
+				panic(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				panic(err)
+			}
+			content = string(b)
+		}
 		f.WriteString(content)
 		f.Close()
 		m.localized[download.DestinationPath] = true
@@ -120,19 +147,82 @@ func (m *MockLocalizer) Prepare(downloads []*Download) error {
 
 func (m *MockUploader) Upload(uploads []*Upload) error {
 	for _, upload := range uploads {
-		f, err := os.Open(path.Join(m.workDir, upload.SourcePath))
-		if err != nil {
-			panic(err)
+		var b []byte
+		if upload.SymlinkTarget != "" {
+			b = []byte("symlink to " + upload.SymlinkTarget)
+		} else {
+			f, err := os.Open(path.Join(m.workDir, upload.SourcePath))
+			if err != nil {
+				panic(err)
+			}
+			b, err = ioutil.ReadAll(f)
+			if err != nil {
+				panic(err)
+			}
+			f.Close()
 		}
-		b, err := ioutil.ReadAll(f)
-		if err != nil {
-			panic(err)
+		if upload.ContentEncoding != "" {
+			var buf bytes.Buffer
+			w, err := newCompressor(&buf, upload.ContentEncoding)
+			if err != nil {
+				panic(err)
+			}
+			w.Write(b)
+			w.Close()
+			b = buf.Bytes()
 		}
 		m.uploaded[upload.DestinationURL] = string(b)
+		m.metadata[upload.DestinationURL] = upload.Metadata
+
+		sum := md5.Sum(b)
+		upload.Size = int64(len(b))
+		upload.MD5 = hex.EncodeToString(sum[:])
+		upload.Generation = 1
 	}
 	return nil
 }
 
+// uploadedOutputs checks that the manifest describes every other uploaded file
+// and returns the uploaded content, excluding the manifest
+func uploadedOutputs(t *testing.T, m *MockUploader) map[string]string {
+	outputs := make(map[string]string)
+	var manifest *Manifest
+	for url, content := range m.uploaded {
+		if path.Base(url) == ManifestName {
+			manifest = &Manifest{}
+			require.Nil(t, json.Unmarshal([]byte(content), manifest))
+		} else {
+			outputs[url] = content
+		}
+	}
+	require.NotNil(t, manifest, "manifest was not uploaded")
+
+	inManifest := make(map[string]string)
+	for _, upload := range manifest.Uploads {
+		inManifest[upload.DestinationURL] = upload.MD5
+	}
+	expected := make(map[string]string)
+	for url, content := range outputs {
+		sum := md5.Sum([]byte(content))
+		expected[url] = hex.EncodeToString(sum[:])
+	}
+	assert.Equal(t, expected, inManifest)
+
+	return outputs
+}
+
+func (m *MockLocalizer) DownloadSizes(downloads []*Download) ([]int64, error) {
+	sizes := make([]int64, len(downloads))
+	for i, download := range downloads {
+		content, exists := m.urlToContent[download.SourceURL]
+		if !exists {
+			return nil, fmt.Errorf("%s does not exist", download.SourceURL)
+		}
+		sizes[i] = int64(len(content))
+	}
+	return sizes, nil
+}
+
 func (m *MockLocalizer) Clean() {
 }
 
@@ -155,7 +245,7 @@ func TestSimpleTransfers(t *testing.T) {
 	err = Execute(workDir, workDir, params, localizer, uploader)
 	require.Nil(t, err)
 
-	assert.Equal(t, map[string]string{"gs://mock/2": "one"}, uploader.uploaded)
+	assert.Equal(t, map[string]string{"gs://mock/2": "one"}, uploadedOutputs(t, uploader))
 }
 
 func TestDirUpload(t *testing.T) {
@@ -176,7 +266,7 @@ func TestDirUpload(t *testing.T) {
 
 	assert.Equal(t,
 		map[string]string{"gs://mock/subdir/2": "two", "gs://mock/1": "one", "gs://mock/subdir/hello.txt": "hello"},
-		uploader.uploaded)
+		uploadedOutputs(t, uploader))
 }
 
 func testGCSMount(t *testing.T, withSymlinks bool) {
@@ -236,10 +326,179 @@ sys.exit(0)
 	err = Execute(rootDir, workDir, params, localizer, uploader)
 	assert.Nil(t, err)
 
-	assert.Equal(t, map[string]string{"gs://mock/2": "mock"}, uploader.uploaded)
+	assert.Equal(t, map[string]string{"gs://mock/2": "mock"}, uploadedOutputs(t, uploader))
 }
 
 func TestGCSMount(t *testing.T) {
 	testGCSMount(t, true)
 	testGCSMount(t, false)
 }
+
+func readResults(t *testing.T, filename string) *Results {
+	b, err := ioutil.ReadFile(filename)
+	require.Nil(t, err)
+	results := &Results{}
+	require.Nil(t, json.Unmarshal(b, results))
+	return results
+}
+
+func TestResultsStatus(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Command:    []string{"bash", "-c", "exit 3"},
+		ResultPath: "results.json"}
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir))
+	require.Nil(t, err)
+	results := readResults(t, path.Join(workDir, "results.json"))
+	assert.Equal(t, StatusCommandFailed, results.Status)
+	assert.Equal(t, 3, results.ExitCode)
+	assert.Equal(t, 0, results.Signal)
+
+	params = &Parameters{
+		Command:    []string{"bash", "-c", "kill -TERM $$"},
+		ResultPath: "results.json"}
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir))
+	require.Nil(t, err)
+	results = readResults(t, path.Join(workDir, "results.json"))
+	assert.Equal(t, StatusCommandFailed, results.Status)
+	assert.Equal(t, -1, results.ExitCode)
+	assert.Equal(t, int(syscall.SIGTERM), results.Signal)
+	assert.Equal(t, "terminated", results.SignalName)
+
+	params = &Parameters{
+		Command:        []string{"sleep", "10"},
+		ResultPath:     "results.json",
+		TimeoutSeconds: 1}
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir))
+	require.Nil(t, err)
+	results = readResults(t, path.Join(workDir, "results.json"))
+	assert.True(t, results.TimedOut)
+	assert.False(t, results.Cancelled)
+	assert.Equal(t, int(syscall.SIGKILL), results.Signal)
+}
+
+func TestResultsWrittenOnCancel(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	params := &Parameters{
+		Command:    []string{"sleep", "10"},
+		ResultPath: "results.json"}
+	err = ExecuteContext(ctx, workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir))
+	require.Nil(t, err)
+	results := readResults(t, path.Join(workDir, "results.json"))
+	assert.True(t, results.Cancelled)
+	assert.Equal(t, StatusCommandFailed, results.Status)
+}
+
+type FailingLocalizer struct {
+	MockLocalizer
+}
+
+func (f *FailingLocalizer) Prepare(downloads []*Download) error {
+	return errors.New("could not download")
+}
+
+type FailingUploader struct{}
+
+func (f *FailingUploader) Upload(uploads []*Upload) error {
+	return errors.New("could not upload")
+}
+
+func TestResultsWrittenOnFailure(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Command:    []string{"true"},
+		ResultPath: "results.json"}
+	err = Execute(workDir, workDir, params, &FailingLocalizer{*NewMockLocalizer(workDir)}, NewMockUploader(workDir))
+	require.NotNil(t, err)
+	results := readResults(t, path.Join(workDir, "results.json"))
+	assert.Equal(t, StatusLocalizationFailed, results.Status)
+	assert.Equal(t, -1, results.ExitCode)
+	assert.Equal(t, "could not download", results.Error)
+
+	params = &Parameters{
+		Uploads:    &UploadPatterns{Filters: []*Filter{&Filter{Pattern: "*"}}, DestinationURLPrefix: "gs://mock"},
+		Command:    []string{"true"},
+		ResultPath: "results.json"}
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), &FailingUploader{})
+	require.NotNil(t, err)
+	results = readResults(t, path.Join(workDir, "results.json"))
+	assert.Equal(t, StatusUploadFailed, results.Status)
+	assert.Equal(t, 0, results.ExitCode)
+}
+
+// FlakyUploader fails its first Upload and delegates the rest
+type FlakyUploader struct {
+	*MockUploader
+	failed bool
+}
+
+func (f *FlakyUploader) Upload(uploads []*Upload) error {
+	if !f.failed {
+		f.failed = true
+		return errors.New("could not upload")
+	}
+	return f.MockUploader.Upload(uploads)
+}
+
+func TestResultsUploadedAfterUploadFailure(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Uploads:    &UploadPatterns{Filters: []*Filter{&Filter{Pattern: "*"}}, DestinationURLPrefix: "gs://mock/out"},
+		Command:    []string{"touch", "output"},
+		ResultPath: "results.json"}
+	uploader := &FlakyUploader{MockUploader: NewMockUploader(workDir)}
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.NotNil(t, err)
+
+	assert.Equal(t, []string{"gs://mock/out/results.json"}, sortedKeys(uploader.uploaded))
+	results := &Results{}
+	require.Nil(t, json.Unmarshal([]byte(uploader.uploaded["gs://mock/out/results.json"]), results))
+	assert.Equal(t, StatusUploadFailed, results.Status)
+	assert.Equal(t, "could not upload", results.Error)
+}
+
+func TestManifest(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{&Filter{Pattern: "*"}},
+			DestinationURLPrefix: "gs://mock/out"},
+		Downloads: []*Download{&Download{SourceURL: "gs://mock/1",
+			DestinationPath: "1"}},
+		Command: []string{"cp", "1", "2"}}
+
+	localizer := NewMockLocalizer(workDir)
+	localizer.urlToContent["gs://mock/1"] = "one"
+	uploader := NewMockUploader(workDir)
+
+	err = Execute(workDir, workDir, params, localizer, uploader)
+	require.Nil(t, err)
+
+	manifest := &Manifest{}
+	require.Nil(t, json.Unmarshal([]byte(uploader.uploaded["gs://mock/out/"+ManifestName]), manifest))
+	require.Equal(t, 1, len(manifest.Uploads))
+	assert.Equal(t, "2", manifest.Uploads[0].SourcePath)
+	assert.Equal(t, "gs://mock/out/2", manifest.Uploads[0].DestinationURL)
+	assert.Equal(t, int64(3), manifest.Uploads[0].Size)
+	assert.Equal(t, int64(1), manifest.Uploads[0].Generation)
+	require.Equal(t, 1, len(manifest.Downloads))
+	assert.Equal(t, "gs://mock/1", manifest.Downloads[0].SourceURL)
+	assert.Equal(t, "1", manifest.Downloads[0].DestinationPath)
+}
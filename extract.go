@@ -0,0 +1,282 @@
+package shepherd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Formats which can be extracted, as determined from the extension of
+// Download.SourceURL
+const (
+	extractFormatTar    = "tar"
+	extractFormatTarGz  = "tar.gz"
+	extractFormatTarZst = "tar.zst"
+	extractFormatZip    = "zip"
+)
+
+func extractFormat(url string) (string, error) {
+	switch {
+	case strings.HasSuffix(url, ".tar"):
+		return extractFormatTar, nil
+	case strings.HasSuffix(url, ".tar.gz") || strings.HasSuffix(url, ".tgz"):
+		return extractFormatTarGz, nil
+	case strings.HasSuffix(url, ".tar.zst") || strings.HasSuffix(url, ".tzst"):
+		return extractFormatTarZst, nil
+	case strings.HasSuffix(url, ".zip"):
+		return extractFormatZip, nil
+	}
+	return "", fmt.Errorf("cannot extract %s: expected a .tar, .tar.gz, .tgz, .tar.zst, .tzst or .zip file", url)
+}
+
+// extraction is a download which needs to be unpacked once it's localized
+type extraction struct {
+	download    *Download
+	archivePath string
+}
+
+// planExtractions returns the downloads to hand to the localizer. Downloads
+// which are to be extracted are redirected to a staging location within
+// shepherdDir, from which extractDownloads unpacks them into their
+// DestinationPath.
+func planExtractions(downloads []*Download) ([]*Download, []*extraction) {
+	localized := make([]*Download, len(downloads))
+	extractions := make([]*extraction, 0)
+	for i, download := range downloads {
+		if !download.Extract {
+			localized[i] = download
+			continue
+		}
+
+		staged := *download
+		staged.DestinationPath = path.Join(shepherdDir, "downloads", strconv.Itoa(i), path.Base(download.SourceURL))
+		staged.Extract = false
+		// the archive itself is never an output
+		staged.UploadPolicy = UploadPolicyNever
+		localized[i] = &staged
+		extractions = append(extractions, &extraction{download: download, archivePath: staged.DestinationPath})
+	}
+	return localized, extractions
+}
+
+// extractDownloads unpacks each archive into the destination of its download,
+// registering every extracted file with inputs so that it isn't mistaken for
+// an output. Archives are deleted once extracted.
+func extractDownloads(workdir string, extractions []*extraction, inputs *inputTracker) error {
+	for _, e := range extractions {
+		format, err := extractFormat(e.download.SourceURL)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Extracting %s into %s", e.download.SourceURL, e.download.DestinationPath)
+		extracted, err := extractArchive(path.Join(workdir, e.archivePath), format, path.Join(workdir, e.download.DestinationPath))
+		if err != nil {
+			return fmt.Errorf("could not extract %s: %s", e.download.SourceURL, err)
+		}
+		err = os.Remove(path.Join(workdir, e.archivePath))
+		if err != nil {
+			return err
+		}
+
+		for _, name := range extracted {
+			err = inputs.add(path.Join(e.download.DestinationPath, name), e.download.UploadPolicy, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// extractArchive unpacks the archive at archivePath into destDir, returning
+// the paths (relative to destDir) of the files and symlinks it created.
+func extractArchive(archivePath string, format string, destDir string) ([]string, error) {
+	err := ensureDirExists(destDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == extractFormatZip {
+		return extractZip(archivePath, destDir)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch format {
+	case extractFormatTarGz:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case extractFormatTarZst:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	return extractTar(r, destDir)
+}
+
+func extractTar(r io.Reader, destDir string) ([]string, error) {
+	extracted := make([]string, 0, 100)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := safeArchivePath(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." {
+			continue
+		}
+		dest := path.Join(destDir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = ensureDirExists(dest)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeExtractedFile(dest, os.FileMode(header.Mode), tr)
+		case tar.TypeSymlink:
+			err = writeExtractedSymlink(dest, header.Linkname)
+		default:
+			log.Printf("Warning: Skipping %s which is neither a file, directory nor symlink", header.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeDir {
+			extracted = append(extracted, name)
+		}
+	}
+	return extracted, nil
+}
+
+func extractZip(archivePath string, destDir string) ([]string, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	extracted := make([]string, 0, len(zr.File))
+	for _, f := range zr.File {
+		name, err := safeArchivePath(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." {
+			continue
+		}
+		dest := path.Join(destDir, name)
+
+		mode := f.Mode()
+		if mode.IsDir() {
+			err = ensureDirExists(dest)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		if mode&os.ModeSymlink != 0 {
+			// zip stores the target of a symlink as its content
+			var target strings.Builder
+			_, err = io.Copy(&target, r)
+			if err == nil {
+				err = writeExtractedSymlink(dest, target.String())
+			}
+		} else {
+			err = writeExtractedFile(dest, mode, r)
+		}
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		extracted = append(extracted, name)
+	}
+	return extracted, nil
+}
+
+// safeArchivePath cleans the name of an archive entry, rejecting any which
+// would be written outside of the destination directory
+func safeArchivePath(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(name, "./"))
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("archive entry %q would be extracted outside of the destination", name)
+	}
+	return cleaned, nil
+}
+
+func writeExtractedFile(dest string, mode os.FileMode, r io.Reader) error {
+	err := ensureParentDirExists(dest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeExtractedSymlink only permits relative targets without any ".."
+// components. Together with safeArchivePath, this guarantees that neither the
+// link nor any file later written through it can end up outside of the
+// destination.
+func writeExtractedSymlink(dest string, target string) error {
+	if path.IsAbs(target) {
+		return fmt.Errorf("symlink %s has absolute target %s", dest, target)
+	}
+	for _, part := range strings.Split(target, "/") {
+		if part == ".." {
+			return fmt.Errorf("symlink %s has target %s which refers to a parent directory", dest, target)
+		}
+	}
+
+	err := ensureParentDirExists(dest)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, dest)
+}
@@ -0,0 +1,130 @@
+package shepherd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testArchiveEntry struct {
+	name     string
+	content  string
+	linkname string
+}
+
+func makeTarGz(t *testing.T, entries []testArchiveEntry) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		if entry.linkname != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.linkname}
+		}
+		require.Nil(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(entry.content))
+		require.Nil(t, err)
+	}
+	require.Nil(t, tw.Close())
+	require.Nil(t, gz.Close())
+	return buf.String()
+}
+
+func makeZip(t *testing.T, entries []testArchiveEntry) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		require.Nil(t, err)
+		_, err = w.Write([]byte(entry.content))
+		require.Nil(t, err)
+	}
+	require.Nil(t, zw.Close())
+	return buf.String()
+}
+
+func TestExtractDownload(t *testing.T) {
+	for _, tc := range []struct {
+		url     string
+		archive func(*testing.T, []testArchiveEntry) string
+	}{
+		{"gs://mock/inputs.tar.gz", makeTarGz},
+		{"gs://mock/inputs.zip", makeZip},
+	} {
+		t.Run(path.Base(tc.url), func(t *testing.T) {
+			workDir, err := ioutil.TempDir("", "TestExtractDownload")
+			require.Nil(t, err)
+			defer os.RemoveAll(workDir)
+
+			params := &Parameters{
+				Uploads: &UploadPatterns{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://mock/out"},
+				Downloads: []*Download{{SourceURL: tc.url,
+					DestinationPath: "in",
+					Extract:         true}},
+				Command: []string{"bash", "-c", "cat in/a in/sub/b > out.txt && echo -n changed > in/a"}}
+
+			localizer := NewMockLocalizer(workDir)
+			localizer.urlToContent[tc.url] = tc.archive(t, []testArchiveEntry{{name: "a", content: "a"}, {name: "sub/b", content: "b"}})
+			uploader := NewMockUploader(workDir)
+
+			err = Execute(workDir, workDir, params, localizer, uploader)
+			require.Nil(t, err)
+
+			// in/sub/b is unchanged and the archive itself is never uploaded
+			assert.Equal(t, map[string]string{"gs://mock/out/out.txt": "ab",
+				"gs://mock/out/in/a": "changed"},
+				uploadedOutputs(t, uploader))
+
+			// and is deleted once extracted
+			_, err = os.Stat(path.Join(workDir, shepherdDir, "downloads", "0", path.Base(tc.url)))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestExtractRejectsTraversal(t *testing.T) {
+	for name, entries := range map[string][]testArchiveEntry{
+		"parent":         {{name: "../escape", content: "x"}},
+		"nested parent":  {{name: "a/../../escape", content: "x"}},
+		"absolute":       {{name: "/escape", content: "x"}},
+		"absolute link":  {{name: "link", linkname: "/etc"}},
+		"relative link":  {{name: "link", linkname: "../.."}},
+		"through a link": {{name: "link", linkname: "dir/../.."}, {name: "link/escape", content: "x"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			workDir, err := ioutil.TempDir("", "TestExtractRejectsTraversal")
+			require.Nil(t, err)
+			defer os.RemoveAll(workDir)
+
+			archivePath := path.Join(workDir, "a.tar.gz")
+			require.Nil(t, ioutil.WriteFile(archivePath, []byte(makeTarGz(t, entries)), 0644))
+
+			_, err = extractArchive(archivePath, extractFormatTarGz, path.Join(workDir, "dest"))
+			assert.NotNil(t, err)
+			_, err = os.Stat(path.Join(workDir, "escape"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestExtractFormat(t *testing.T) {
+	format, err := extractFormat("gs://bucket/ref.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, extractFormatTarGz, format)
+	format, err = extractFormat("gs://bucket/ref.tar.zst")
+	assert.Nil(t, err)
+	assert.Equal(t, extractFormatTarZst, format)
+
+	_, err = extractFormat("gs://bucket/ref.rar")
+	assert.NotNil(t, err)
+	assert.NotNil(t, validateParameters(&Parameters{Command: []string{"true"},
+		Downloads: []*Download{{SourceURL: "gs://bucket/ref.rar", DestinationPath: "ref", Extract: true}}}))
+}
@@ -0,0 +1,105 @@
+package shepherd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Values for FailureUploads.Policy
+const (
+	// FailureUploadAll uploads the outputs as if the command had succeeded. This is the default.
+	FailureUploadAll = "all"
+	// FailureUploadLogs only uploads the stdout, stderr and result files
+	FailureUploadLogs = "logs"
+	// FailureUploadSkip uploads nothing
+	FailureUploadSkip = "skip"
+)
+
+// FailureUploads controls what is uploaded when the command fails, so that
+// failed runs don't pollute the location which downstream jobs poll for
+// outputs. If DestinationURLPrefix is set, it replaces the prefix of every
+// upload rule. With FailureUploadLogs, the logs are uploaded to
+// DestinationURLPrefix, or failing that the prefix of the first upload rule.
+type FailureUploads struct {
+	Policy               string `json:"policy"`
+	DestinationURLPrefix string `json:"destination_url_prefix"`
+}
+
+func validateFailureUploads(v *validator, field string, failure *FailureUploads) {
+	switch failure.Policy {
+	case "", FailureUploadAll, FailureUploadLogs, FailureUploadSkip:
+	default:
+		v.check(field+".policy", fmt.Errorf("unknown failure upload policy %q, expected %q, %q or %q", failure.Policy, FailureUploadAll, FailureUploadLogs, FailureUploadSkip))
+	}
+	if failure.DestinationURLPrefix != "" {
+		v.check(field+".destination_url_prefix", validateURL(failure.DestinationURLPrefix))
+	}
+}
+
+// failureUploadRules returns the upload rules to apply after the command failed
+func (params *Parameters) failureUploadRules() []*UploadPatterns {
+	rules := params.uploadRules()
+	failure := params.OnFailure
+	if failure == nil {
+		return rules
+	}
+
+	switch failure.Policy {
+	case FailureUploadSkip:
+		return nil
+	case FailureUploadLogs:
+		return params.logUploadRules()
+	}
+
+	if failure.DestinationURLPrefix == "" {
+		return rules
+	}
+	redirected := make([]*UploadPatterns, len(rules))
+	for i, rule := range rules {
+		copied := *rule
+		copied.DestinationURLPrefix = failure.DestinationURLPrefix
+		redirected[i] = &copied
+	}
+	return redirected
+}
+
+// escapeGlob quotes p so that, as a Filter pattern, it only matches itself
+func escapeGlob(p string) string {
+	var escaped strings.Builder
+	for _, c := range p {
+		switch c {
+		case '*', '?', '[', '\\', '!':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// logDestinationPrefix returns where logs go when the outputs don't: the
+// failure destination, or failing that the prefix of the first upload rule
+func (params *Parameters) logDestinationPrefix() string {
+	if params.OnFailure != nil && params.OnFailure.DestinationURLPrefix != "" {
+		return params.OnFailure.DestinationURLPrefix
+	}
+	if rules := params.uploadRules(); len(rules) > 0 {
+		return rules[0].DestinationURLPrefix
+	}
+	return ""
+}
+
+// logUploadRules returns the rule uploading the stdout, stderr and result
+// files to logDestinationPrefix
+func (params *Parameters) logUploadRules() []*UploadPatterns {
+	prefix := params.logDestinationPrefix()
+	filters := make([]*Filter, 0, 3)
+	for _, logPath := range []string{params.StdoutPath, params.StderrPath, params.ResultPath} {
+		if logPath != "" {
+			filters = append(filters, &Filter{Pattern: "/" + escapeGlob(logPath)})
+		}
+	}
+	if prefix == "" || len(filters) == 0 {
+		return nil
+	}
+	return []*UploadPatterns{{Filters: filters, DestinationURLPrefix: prefix}}
+}
@@ -0,0 +1,94 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runFailingJob(t *testing.T, onFailure *FailureUploads) map[string]string {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{{Pattern: "*"}},
+			DestinationURLPrefix: "gs://mock/out"},
+		Command:    []string{"bash", "-c", "echo -n partial > out.txt && echo -n failed && exit 1"},
+		StdoutPath: "logs/stdout[1].txt",
+		StderrPath: "logs/stderr.txt",
+		OnFailure:  onFailure}
+
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.Nil(t, err)
+	return uploader.uploaded
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestFailureUploadAll(t *testing.T) {
+	uploaded := runFailingJob(t, nil)
+	assert.Equal(t, "partial", uploaded["gs://mock/out/out.txt"])
+	assert.Equal(t, "failed", uploaded["gs://mock/out/logs/stdout[1].txt"])
+}
+
+func TestFailureUploadLogs(t *testing.T) {
+	uploaded := runFailingJob(t, &FailureUploads{Policy: FailureUploadLogs})
+	assert.Equal(t, []string{"gs://mock/out/logs/stderr.txt", "gs://mock/out/logs/stdout[1].txt", "gs://mock/out/" + ManifestName}, sortedKeys(uploaded))
+}
+
+func TestFailureUploadPrefix(t *testing.T) {
+	uploaded := runFailingJob(t, &FailureUploads{DestinationURLPrefix: "gs://mock/failed"})
+	assert.Equal(t, []string{"gs://mock/failed/logs/stderr.txt", "gs://mock/failed/logs/stdout[1].txt", "gs://mock/failed/out.txt", "gs://mock/failed/" + ManifestName}, sortedKeys(uploaded))
+}
+
+func TestFailureUploadSkip(t *testing.T) {
+	uploaded := runFailingJob(t, &FailureUploads{Policy: FailureUploadSkip})
+	assert.Empty(t, uploaded)
+}
+
+func TestFailureUploadOnSuccess(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{{Pattern: "*"}},
+			DestinationURLPrefix: "gs://mock/out"},
+		Command:   []string{"bash", "-c", "echo -n done > out.txt"},
+		OnFailure: &FailureUploads{Policy: FailureUploadSkip}}
+
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"gs://mock/out/out.txt": "done"}, uploadedOutputs(t, uploader))
+}
+
+func TestValidateFailureUploads(t *testing.T) {
+	for failure, field := range map[*FailureUploads]string{
+		{Policy: FailureUploadLogs, DestinationURLPrefix: "gs://bucket/failed"}: "",
+		{Policy: "some"}:                      "on_failure.policy",
+		{DestinationURLPrefix: "/tmp/failed"}: "on_failure.destination_url_prefix",
+	} {
+		v := &validator{}
+		validateFailureUploads(v, "on_failure", failure)
+		if field == "" {
+			assert.Nil(t, v.err())
+		} else {
+			require.Equal(t, 1, len(v.errors))
+			assert.Equal(t, field, v.errors[0].Field)
+		}
+	}
+}
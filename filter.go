@@ -0,0 +1,148 @@
+package shepherd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Values for Filter.Type
+const (
+	FileTypeRegular = "file"
+	FileTypeSymlink = "symlink"
+	FileTypeEmpty   = "empty"
+)
+
+type compiledFilter struct {
+	pattern *globPattern
+	regex   *regexp.Regexp
+	filter  *Filter
+	exclude bool
+}
+
+// filterSet is the compiled form of a list of Filters
+type filterSet []*compiledFilter
+
+func compileFilters(filters []*Filter) (filterSet, error) {
+	compiled := make(filterSet, len(filters))
+	for i, filter := range filters {
+		c, err := compileFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = c
+	}
+	return compiled, nil
+}
+
+func compileFilter(filter *Filter) (*compiledFilter, error) {
+	c := &compiledFilter{filter: filter, exclude: filter.Exclude}
+
+	if filter.Pattern != "" {
+		pattern, err := compileGlob(filter.Pattern)
+		if err != nil {
+			return nil, &FieldError{Field: "pattern", Err: err}
+		}
+		c.pattern = pattern
+		// negating a pattern flips the effect of the filter
+		c.exclude = filter.Exclude != pattern.negated
+	}
+
+	if filter.Regex != "" {
+		regex, err := regexp.Compile(filter.Regex)
+		if err != nil {
+			return nil, &FieldError{Field: "regex", Err: fmt.Errorf("invalid regex %q: %s", filter.Regex, err)}
+		}
+		c.regex = regex
+	}
+
+	if c.pattern == nil && c.regex == nil && !filter.hasPredicates() {
+		return nil, errors.New("filter must have a pattern, regex or predicate")
+	}
+
+	if filter.MinSize != nil && filter.MaxSize != nil && *filter.MinSize > *filter.MaxSize {
+		return nil, &FieldError{Field: "min_size", Err: fmt.Errorf("filter min_size (%d) is larger than max_size (%d)", *filter.MinSize, *filter.MaxSize)}
+	}
+
+	switch filter.Type {
+	case "", FileTypeRegular, FileTypeSymlink, FileTypeEmpty:
+	default:
+		return nil, &FieldError{Field: "type", Err: fmt.Errorf("unknown filter type %q, expected one of %q, %q or %q", filter.Type, FileTypeRegular, FileTypeSymlink, FileTypeEmpty)}
+	}
+
+	return c, nil
+}
+
+func (f *Filter) hasPredicates() bool {
+	return f.MinSize != nil || f.MaxSize != nil || f.Type != "" || f.ModifiedAfter != nil || f.ModifiedBefore != nil
+}
+
+// matchesFile reports whether every criteria of the filter holds for the file
+// at relPath
+func (c *compiledFilter) matchesFile(relPath string, info os.FileInfo) bool {
+	if c.pattern != nil && !c.pattern.matches(relPath, false) {
+		return false
+	}
+	if c.regex != nil && !c.regex.MatchString(relPath) {
+		return false
+	}
+
+	f := c.filter
+	if f.MinSize != nil && info.Size() < *f.MinSize {
+		return false
+	}
+	if f.MaxSize != nil && info.Size() > *f.MaxSize {
+		return false
+	}
+	if f.ModifiedAfter != nil && !info.ModTime().After(*f.ModifiedAfter) {
+		return false
+	}
+	if f.ModifiedBefore != nil && !info.ModTime().Before(*f.ModifiedBefore) {
+		return false
+	}
+
+	switch f.Type {
+	case FileTypeRegular:
+		return info.Mode().IsRegular()
+	case FileTypeSymlink:
+		return info.Mode()&os.ModeSymlink != 0
+	case FileTypeEmpty:
+		return info.Mode().IsRegular() && info.Size() == 0
+	}
+
+	return true
+}
+
+// matchesDir reports whether the filter applies to the directory at relPath.
+// Only filters consisting solely of a glob pattern apply to directories.
+func (c *compiledFilter) matchesDir(relPath string) bool {
+	if c.pattern == nil || c.regex != nil || c.filter.hasPredicates() {
+		return false
+	}
+	return c.pattern.matches(relPath, true)
+}
+
+// includes reports whether the file at relPath should be uploaded. The last
+// filter to match decides, and files which match no filter are excluded.
+func (fs filterSet) includes(relPath string, info os.FileInfo) bool {
+	included := false
+	for _, filter := range fs {
+		if filter.matchesFile(relPath, info) {
+			included = !filter.exclude
+		}
+	}
+	return included
+}
+
+// prunes reports whether the directory at relPath has been excluded, in which
+// case nothing beneath it can be included
+func (fs filterSet) prunes(relPath string) bool {
+	pruned := false
+	for _, filter := range fs {
+		if filter.matchesDir(relPath) {
+			pruned = filter.exclude
+		}
+	}
+	return pruned
+}
@@ -0,0 +1,100 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeFileInfo struct {
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *fakeFileInfo) Name() string       { return "fake" }
+func (f *fakeFileInfo) Size() int64        { return f.size }
+func (f *fakeFileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fakeFileInfo) ModTime() time.Time { return f.modTime }
+func (f *fakeFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fakeFileInfo) Sys() interface{}   { return nil }
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func TestFilterPredicates(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+	regular := &fakeFileInfo{size: 100, mode: 0644, modTime: now}
+	empty := &fakeFileInfo{size: 0, mode: 0644, modTime: now}
+	symlink := &fakeFileInfo{size: 10, mode: os.ModeSymlink | 0777, modTime: earlier}
+
+	cases := []struct {
+		filter  *Filter
+		path    string
+		info    os.FileInfo
+		matches bool
+	}{
+		{&Filter{Regex: `^out/.*\.csv$`}, "out/a.csv", regular, true},
+		{&Filter{Regex: `^out/.*\.csv$`}, "x/out/a.csv", regular, false},
+		{&Filter{Pattern: "*.csv", Regex: "^a"}, "a.csv", regular, true},
+		{&Filter{Pattern: "*.csv", Regex: "^a"}, "b.csv", regular, false},
+		{&Filter{MinSize: int64Ptr(100)}, "a", regular, true},
+		{&Filter{MinSize: int64Ptr(101)}, "a", regular, false},
+		{&Filter{MaxSize: int64Ptr(99)}, "a", regular, false},
+		{&Filter{MaxSize: int64Ptr(100)}, "a", regular, true},
+		{&Filter{Type: FileTypeRegular}, "a", regular, true},
+		{&Filter{Type: FileTypeRegular}, "a", symlink, false},
+		{&Filter{Type: FileTypeSymlink}, "a", symlink, true},
+		{&Filter{Type: FileTypeEmpty}, "a", empty, true},
+		{&Filter{Type: FileTypeEmpty}, "a", regular, false},
+		{&Filter{ModifiedAfter: &earlier}, "a", regular, true},
+		{&Filter{ModifiedAfter: &earlier}, "a", symlink, false},
+		{&Filter{ModifiedBefore: &now}, "a", symlink, true},
+		{&Filter{ModifiedBefore: &now}, "a", regular, false},
+	}
+
+	for _, c := range cases {
+		compiled, err := compileFilter(c.filter)
+		require.Nil(t, err)
+		assert.Equal(t, c.matches, compiled.matchesFile(c.path, c.info), "%+v against %s", c.filter, c.path)
+	}
+}
+
+func TestInvalidFilters(t *testing.T) {
+	for _, filter := range []*Filter{
+		&Filter{},
+		&Filter{Regex: "("},
+		&Filter{Type: "socket"},
+		&Filter{MinSize: int64Ptr(10), MaxSize: int64Ptr(1)},
+	} {
+		_, err := compileFilter(filter)
+		assert.NotNil(t, err, "%+v", filter)
+	}
+}
+
+func TestFindNewFilesWithPredicates(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	require.Nil(t, ioutil.WriteFile(path.Join(workDir, "result.txt"), []byte("result"), 0644))
+	require.Nil(t, ioutil.WriteFile(path.Join(workDir, "placeholder.txt"), []byte{}, 0644))
+	require.Nil(t, ioutil.WriteFile(path.Join(workDir, "scratch.bin"), make([]byte, 1000), 0644))
+
+	filters := []*Filter{
+		{Pattern: "*"},
+		{Type: FileTypeEmpty, Exclude: true},
+		{MinSize: int64Ptr(500), Exclude: true}}
+	filenames, err := findNewFiles(workDir, filters, NewMockLocalizer(workDir))
+	require.Nil(t, err)
+	sort.Strings(filenames)
+	assert.Equal(t, []string{"result.txt"}, filenames)
+}
@@ -0,0 +1,137 @@
+package shepherd
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// globPattern is a compiled Filter pattern. See Filter for the syntax.
+type globPattern struct {
+	re      *regexp.Regexp
+	negated bool
+	dirOnly bool
+}
+
+// compileGlob translates a gitignore style pattern into a regular expression
+// which is matched against paths relative to the work directory.
+func compileGlob(pattern string) (*globPattern, error) {
+	g := &globPattern{}
+
+	p := pattern
+	if strings.HasPrefix(p, "!") {
+		g.negated = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, "\\!") {
+		p = p[1:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		g.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+
+	if p == "" {
+		return nil, fmt.Errorf("pattern %q does not match anything", pattern)
+	}
+
+	// a slash anywhere but the end anchors the pattern to the work directory,
+	// otherwise it can match at any depth
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		if segment == "**" {
+			if last {
+				// "a/**" matches everything inside a, but not a itself
+				if i == 0 {
+					re.WriteString(".*")
+				} else {
+					re.WriteString(".+")
+				}
+			} else {
+				// "**/" matches zero or more directories
+				re.WriteString("(?:.*/)?")
+			}
+			continue
+		}
+
+		err := translateSegment(&re, segment, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !last {
+			re.WriteString("/")
+		}
+	}
+	re.WriteString("$")
+
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+	}
+	g.re = compiled
+
+	return g, nil
+}
+
+// translateSegment appends the regular expression for a single path component
+// of a glob pattern
+func translateSegment(re *strings.Builder, segment string, pattern string) error {
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		switch c {
+		case '*':
+			// consecutive asterisks which are not a whole segment behave like one
+			for i+1 < len(segment) && segment[i+1] == '*' {
+				i++
+			}
+			re.WriteString("[^/]*")
+		case '?':
+			re.WriteString("[^/]")
+		case '\\':
+			if i+1 >= len(segment) {
+				return fmt.Errorf("invalid pattern %q: trailing backslash", pattern)
+			}
+			i++
+			re.WriteString(regexp.QuoteMeta(string(segment[i])))
+		case '[':
+			end := strings.IndexByte(segment[i+1:], ']')
+			if end < 0 {
+				return fmt.Errorf("invalid pattern %q: unterminated character class", pattern)
+			}
+			class := segment[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return nil
+}
+
+// matches reports whether the pattern matches relPath. A pattern which
+// matches a directory also matches everything within that directory.
+func (g *globPattern) matches(relPath string, isDir bool) bool {
+	if (isDir || !g.dirOnly) && g.re.MatchString(relPath) {
+		return true
+	}
+	for dir := path.Dir(relPath); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if g.re.MatchString(dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobMatches(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		matches bool
+	}{
+		// unanchored patterns match at any depth
+		{"*.csv", "a.csv", false, true},
+		{"*.csv", "results/x/a.csv", false, true},
+		{"*.csv", "a.csv.gz", false, false},
+		{"a?.txt", "dir/ab.txt", false, true},
+		{"a?.txt", "a/b.txt", false, false},
+		{"[ab].txt", "b.txt", false, true},
+		{"[!ab].txt", "b.txt", false, false},
+		{"[!ab].txt", "c.txt", false, true},
+		{"logs", "x/logs/out.txt", false, true},
+		// anchored patterns only match relative to the work directory
+		{"/a.csv", "a.csv", false, true},
+		{"/a.csv", "sub/a.csv", false, false},
+		{"sub/*.txt", "sub/a.txt", false, true},
+		{"sub/*.txt", "x/sub/a.txt", false, false},
+		{"sub/*.txt", "sub/deeper/a.txt", false, false},
+		// double star
+		{"results/**/*.csv", "results/a.csv", false, true},
+		{"results/**/*.csv", "results/x/y/a.csv", false, true},
+		{"results/**/*.csv", "other/results/a.csv", false, false},
+		{"**/cache", "cache", true, true},
+		{"**/cache", "a/b/cache/file", false, true},
+		{"results/**", "results/x/y", false, true},
+		{"results/**", "results", true, false},
+		{"**", "anything/at/all", false, true},
+		{"a**b", "axxb", false, true},
+		{"a**b", "ax/xb", false, false},
+		// directory only patterns
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "build/out.o", false, true},
+		{"build/", "src/build/out.o", false, true},
+		// escapes
+		{"\\*.txt", "*.txt", false, true},
+		{"\\*.txt", "a.txt", false, false},
+		{"\\!important", "!important", false, true},
+	}
+
+	for _, c := range cases {
+		g, err := compileGlob(c.pattern)
+		require.Nil(t, err, c.pattern)
+		assert.Equal(t, c.matches, g.matches(c.path, c.isDir), "pattern %q against %q (dir=%v)", c.pattern, c.path, c.isDir)
+	}
+}
+
+func TestInvalidGlobs(t *testing.T) {
+	for _, pattern := range []string{"", "!", "/", "a[bc", "a\\"} {
+		_, err := compileGlob(pattern)
+		assert.NotNil(t, err, pattern)
+	}
+}
+
+func TestFilterPrecedence(t *testing.T) {
+	cases := []struct {
+		filters  []*Filter
+		path     string
+		included bool
+	}{
+		{[]*Filter{}, "a.txt", false},
+		{[]*Filter{{Pattern: "*"}}, "a.txt", true},
+		{[]*Filter{{Pattern: "*"}, {Pattern: "*.log", Exclude: true}}, "x/a.log", false},
+		{[]*Filter{{Pattern: "*.log", Exclude: true}, {Pattern: "*"}}, "x/a.log", true},
+		{[]*Filter{{Pattern: "*"}, {Pattern: "!*.log"}}, "a.log", false},
+		{[]*Filter{{Pattern: "*"}, {Pattern: "*.log", Exclude: true}, {Pattern: "!keep.log", Exclude: true}}, "keep.log", true},
+		{[]*Filter{{Pattern: "*"}, {Pattern: "scratch/", Exclude: true}}, "scratch/big.bin", false},
+	}
+
+	for _, c := range cases {
+		fs, err := compileFilters(c.filters)
+		require.Nil(t, err)
+		assert.Equal(t, c.included, fs.includes(c.path, &fakeFileInfo{size: 1, mode: 0644}), "%s", c.path)
+	}
+}
+
+func TestFindNewFilesWithDoubleStar(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	for _, filename := range []string{"results/a.csv", "results/x/y/b.csv", "results/x/c.txt", "d.csv", "scratch/e.csv"} {
+		p := path.Join(workDir, filename)
+		require.Nil(t, ensureParentDirExists(p))
+		require.Nil(t, ioutil.WriteFile(p, []byte(filename), 0644))
+	}
+
+	filenames, err := findNewFiles(workDir, []*Filter{{Pattern: "results/**/*.csv"}}, NewMockLocalizer(workDir))
+	require.Nil(t, err)
+	sort.Strings(filenames)
+	assert.Equal(t, []string{"results/a.csv", "results/x/y/b.csv"}, filenames)
+
+	// an excluded directory is pruned and cannot be re-included
+	filenames, err = findNewFiles(workDir, []*Filter{{Pattern: "*.csv"}, {Pattern: "scratch/", Exclude: true}, {Pattern: "e.csv"}}, NewMockLocalizer(workDir))
+	require.Nil(t, err)
+	sort.Strings(filenames)
+	assert.Equal(t, []string{"d.csv", "results/a.csv", "results/x/y/b.csv"}, filenames)
+}
@@ -0,0 +1,173 @@
+package shepherd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// helperArg is passed as argv[0] when shepherd re-executes itself to finish
+// setting up the environment of a host command (joining its cgroup, building
+// the sandbox) before exec'ing the real command.
+const helperArg = "shepherd-exec-helper"
+
+// helperConfigEnv names the environment variable used to pass the
+// configuration to the re-executed process.
+const helperConfigEnv = "SHEPHERD_EXEC_HELPER_CONFIG"
+
+type helperConfig struct {
+	CgroupProcsPath string         `json:"cgroup_procs_path"`
+	Sandbox         *sandboxConfig `json:"sandbox"`
+}
+
+func init() {
+	// when re-executed by wrapWithHelper we need to finish setting up before
+	// replacing ourselves with the command
+	if len(os.Args) > 0 && os.Args[0] == helperArg {
+		err := runHelper(os.Args[1:])
+		fmt.Fprintf(os.Stderr, "shepherd exec helper: %s\n", err)
+		os.Exit(125)
+	}
+}
+
+// isolateHostCommand applies the sandbox and resource limits requested for a
+// command which runs directly on the host. If resource limits were given, the
+// cgroup the command will run in is returned and the caller is responsible for
+// removing it once the command has completed.
+func isolateHostCommand(cmd *exec.Cmd, workdir string, sandbox *Sandbox, resources *ResourceLimits) (*cgroup, error) {
+	config := &helperConfig{}
+
+	var cg *cgroup
+	if resources != nil {
+		var err error
+		cg, err = newCgroup(fmt.Sprintf("shepherd-%d-%d", os.Getpid(), time.Now().UnixNano()), resources)
+		if err != nil {
+			return nil, err
+		}
+		config.CgroupProcsPath = cg.procsPath()
+	}
+
+	if sandbox != nil {
+		err := sandboxCommand(cmd, workdir, sandbox, config)
+		if err != nil {
+			if cg != nil {
+				cg.remove()
+			}
+			return nil, err
+		}
+	}
+
+	err := wrapWithHelper(cmd, config)
+	if err != nil {
+		if cg != nil {
+			cg.remove()
+		}
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// wrapWithHelper rewrites cmd so that shepherd itself is executed first and
+// applies config before exec'ing the original command.
+func wrapWithHelper(cmd *exec.Cmd, config *helperConfig) error {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, helperConfigEnv+"="+string(b))
+
+	cmd.Args = append([]string{helperArg, cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+
+	return nil
+}
+
+// runHelper is executed in place of the command. args holds the path of the
+// command followed by its argv. It only returns if something went wrong.
+func runHelper(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("expected command path and arguments but got %v", args)
+	}
+
+	config := helperConfig{}
+	err := json.Unmarshal([]byte(os.Getenv(helperConfigEnv)), &config)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %s", helperConfigEnv, err)
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, helperConfigEnv+"=") {
+			env = append(env, v)
+		}
+	}
+
+	// join the cgroup before the sandbox makes /sys/fs/cgroup read-only
+	if config.CgroupProcsPath != "" {
+		err = ioutil.WriteFile(config.CgroupProcsPath, []byte("0"), 0644)
+		if err != nil {
+			return fmt.Errorf("joining cgroup: %s", err)
+		}
+	}
+
+	if config.Sandbox != nil {
+		err = setupSandbox(config.Sandbox)
+		if err != nil {
+			return err
+		}
+		return runInit(args[0], args[1:], env)
+	}
+
+	return syscall.Exec(args[0], args[1:], env)
+}
+
+// runInit runs the command as a child of the helper, which is the init of the
+// sandbox's pid namespace. The kernel drops signals sent to an init without a
+// handler for them, so the helper forwards them to the command, reaps any
+// orphaned processes and exits once the command does. A command killed by a
+// signal is reported as exiting with 128 plus the signal, as the init can't be
+// killed by its own signal.
+func runInit(path string, argv []string, env []string) error {
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	pid, err := syscall.ForkExec(path, argv, &syscall.ProcAttr{Env: env, Files: []uintptr{0, 1, 2}})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for sig := range signals {
+			syscall.Kill(pid, sig.(syscall.Signal))
+		}
+	}()
+
+	for {
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if wpid != pid {
+			continue
+		}
+		if status.Signaled() {
+			os.Exit(128 + int(status.Signal()))
+		}
+		os.Exit(status.ExitStatus())
+	}
+}
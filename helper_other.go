@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package shepherd
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// cgroup is only supported on linux
+type cgroup struct{}
+
+func (c *cgroup) oomKilled() (bool, error) {
+	return false, nil
+}
+
+func (c *cgroup) remove() {
+}
+
+func isolateHostCommand(cmd *exec.Cmd, workdir string, sandbox *Sandbox, resources *ResourceLimits) (*cgroup, error) {
+	return nil, errors.New("sandbox and resource limits for host commands are only supported on linux")
+}
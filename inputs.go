@@ -0,0 +1,194 @@
+package shepherd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// Values for Download.UploadPolicy and Parameters.InputUploadPolicy, the
+// latter applying to downloads which do not specify a policy of their own.
+// When no policy is given, a localized file is only uploaded if its
+// modification time changed.
+const (
+	// UploadPolicyNever never uploads the localized file, even if the command modified it
+	UploadPolicyNever = "never"
+	// UploadPolicyIfChanged uploads the localized file if the command changed its content
+	UploadPolicyIfChanged = "if_changed"
+)
+
+func validateUploadPolicy(policy string) error {
+	switch policy {
+	case "", UploadPolicyNever, UploadPolicyIfChanged:
+		return nil
+	}
+	return fmt.Errorf("unknown upload policy %q, expected %q or %q", policy, UploadPolicyNever, UploadPolicyIfChanged)
+}
+
+type trackedInput struct {
+	policy      string
+	fingerprint string
+	// extracted inputs are not known to the localizer, so we keep track of
+	// their modification time ourselves
+	extracted bool
+	modTime   time.Time
+	// the size, modification and change times of an if_changed input when it
+	// was last fingerprinted, so it is only hashed again once one changes
+	hashedSize       int64
+	hashedModTime    time.Time
+	hashedChangeTime time.Time
+	unchanged        bool
+}
+
+// inputTracker decides whether localized files should be treated as outputs,
+// applying the upload policy of each download on top of the localizer's own
+// check.
+type inputTracker struct {
+	workdir       string
+	localizer     HasLocalizedCheck
+	defaultPolicy string
+	inputs        map[string]*trackedInput
+}
+
+// newInputTracker must be called after the downloads have been localized, as
+// it records the fingerprint of each file which needs to be checked for changes.
+func newInputTracker(workdir string, downloads []*Download, defaultPolicy string, localizer HasLocalizedCheck) (*inputTracker, error) {
+	t := &inputTracker{workdir: workdir,
+		localizer:     localizer,
+		defaultPolicy: defaultPolicy,
+		inputs:        make(map[string]*trackedInput)}
+
+	for _, download := range downloads {
+		err := t.add(download.DestinationPath, download.UploadPolicy, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// add starts tracking a localized file
+func (t *inputTracker) add(p string, policy string, extracted bool) error {
+	if policy == "" {
+		policy = t.defaultPolicy
+	}
+
+	p = path.Clean(p)
+	input := &trackedInput{policy: policy, extracted: extracted}
+	if policy == UploadPolicyIfChanged {
+		filename := path.Join(t.workdir, p)
+		fi, err := os.Lstat(filename)
+		if err != nil {
+			return err
+		}
+		fingerprint, err := fingerprintFile(filename)
+		if err != nil {
+			return err
+		}
+		input.fingerprint = fingerprint
+		input.recordHashed(fi, true)
+	}
+	if extracted {
+		fi, err := os.Lstat(path.Join(t.workdir, p))
+		if err != nil {
+			return err
+		}
+		input.modTime = fi.ModTime()
+	}
+
+	t.inputs[p] = input
+	return nil
+}
+
+// paths returns every localized file being tracked
+func (t *inputTracker) paths() []string {
+	paths := make([]string, 0, len(t.inputs))
+	for p := range t.inputs {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func (t *inputTracker) WasLocalized(p string) bool {
+	input, exists := t.inputs[p]
+	if !exists {
+		return t.localizer.WasLocalized(p)
+	}
+
+	switch input.policy {
+	case UploadPolicyNever:
+		return true
+	case UploadPolicyIfChanged:
+		return input.isUnchanged(path.Join(t.workdir, p))
+	}
+
+	if input.extracted {
+		fi, err := os.Lstat(path.Join(t.workdir, p))
+		return err == nil && fi.ModTime().Equal(input.modTime)
+	}
+	return t.localizer.WasLocalized(p)
+}
+
+// isUnchanged reports whether an if_changed input still has the content it
+// was localized with, only hashing it again if its size, modification or
+// change time differ from when it was last hashed
+func (input *trackedInput) isUnchanged(filename string) bool {
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		// if it can no longer be read, there's nothing we can upload
+		return true
+	}
+	if fi.Size() == input.hashedSize && fi.ModTime().Equal(input.hashedModTime) &&
+		changeTime(fi).Equal(input.hashedChangeTime) {
+		return input.unchanged
+	}
+
+	fingerprint, err := fingerprintFile(filename)
+	if err != nil {
+		return true
+	}
+	input.recordHashed(fi, fingerprint == input.fingerprint)
+	return input.unchanged
+}
+
+func (input *trackedInput) recordHashed(fi os.FileInfo, unchanged bool) {
+	input.hashedSize = fi.Size()
+	input.hashedModTime = fi.ModTime()
+	input.hashedChangeTime = changeTime(fi)
+	input.unchanged = unchanged
+}
+
+// fingerprintFile returns a digest of the file's content, or of its target if
+// it is a symlink (as is the case for inputs mounted via gcsfuse) so that large
+// read-only inputs don't need to be read in full.
+func fingerprintFile(filename string) (string, error) {
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filename)
+		if err != nil {
+			return "", err
+		}
+		return "symlink:" + target, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,17 @@
+package shepherd
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// changeTime returns when the file's inode last changed, which unlike its
+// modification time can't be set back by the command
+func changeTime(fi os.FileInfo) time.Time {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+}
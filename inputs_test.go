@@ -0,0 +1,65 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadChangedInputs(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{&Filter{Pattern: "*"}},
+			DestinationURLPrefix: "gs://mock/out"},
+		Downloads: []*Download{
+			&Download{SourceURL: "gs://mock/changed", DestinationPath: "changed"},
+			&Download{SourceURL: "gs://mock/unchanged", DestinationPath: "unchanged"},
+			&Download{SourceURL: "gs://mock/never", DestinationPath: "never", UploadPolicy: UploadPolicyNever},
+		},
+		InputUploadPolicy: UploadPolicyIfChanged,
+		// preserve the mtime so that only the content reveals the change
+		Command: []string{"bash", "-c", "cp -p changed orig && echo -n db2 > changed && touch -r orig changed && rm orig && echo -n x > never"}}
+
+	localizer := NewMockLocalizer(workDir)
+	localizer.urlToContent["gs://mock/changed"] = "db1"
+	localizer.urlToContent["gs://mock/unchanged"] = "u"
+	localizer.urlToContent["gs://mock/never"] = "n"
+	uploader := NewMockUploader(workDir)
+
+	err = Execute(workDir, workDir, params, localizer, uploader)
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string]string{"gs://mock/out/changed": "db2"}, uploadedOutputs(t, uploader))
+}
+
+func TestValidateUploadPolicy(t *testing.T) {
+	params := &Parameters{Command: []string{"true"},
+		Downloads: []*Download{&Download{SourceURL: "gs://mock/a", DestinationPath: "a", UploadPolicy: "sometimes"}}}
+	assert.NotNil(t, validateParameters(params))
+}
+
+func TestInputHashCached(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	filename := path.Join(workDir, "input")
+	require.Nil(t, ioutil.WriteFile(filename, []byte("a"), 0644))
+	downloads := []*Download{{SourceURL: "gs://mock/input", DestinationPath: "input"}}
+	tracker, err := newInputTracker(workDir, downloads, UploadPolicyIfChanged, NewMockLocalizer(workDir))
+	require.Nil(t, err)
+
+	// not hashed again while the file's stat is the same
+	tracker.inputs["input"].fingerprint = "sha256:stale"
+	assert.True(t, tracker.WasLocalized("input"))
+
+	require.Nil(t, ioutil.WriteFile(filename, []byte("ab"), 0644))
+	assert.False(t, tracker.WasLocalized("input"))
+}
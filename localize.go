@@ -2,6 +2,8 @@ package shepherd
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -102,12 +104,29 @@ func (d *Downloader) download(ctx context.Context, workdir string, download *Dow
 	}
 	defer dst.Close()
 
+	if download.Decompress != "" {
+		// fetch the stored bytes, even if GCS would transcode them, as we
+		// decompress them ourselves
+		object = object.ReadCompressed(true)
+	}
+
 	reader, err := object.NewReader(ctx)
 	if err != nil {
 		return "", err
 	}
+	defer reader.Close()
+
+	var src io.Reader = reader
+	if download.Decompress != "" {
+		decompressor, err := newDecompressor(reader, download.Decompress)
+		if err != nil {
+			return "", err
+		}
+		defer decompressor.Close()
+		src = decompressor
+	}
 
-	_, err = io.Copy(dst, reader)
+	_, err = io.Copy(dst, src)
 	if err != nil {
 		return "", err
 	}
@@ -115,36 +134,80 @@ func (d *Downloader) download(ctx context.Context, workdir string, download *Dow
 	return dstPath, nil
 }
 
-func upload(ctx context.Context, client *storage.Client, srcPath string, destURL string) error {
-	bucketName, keyName := splitGSCPath(destURL)
+func upload(ctx context.Context, client *storage.Client, srcPath string, uploadRec *Upload) error {
+	bucketName, keyName := splitGSCPath(uploadRec.DestinationURL)
 	bucket := client.Bucket(bucketName)
 	object := bucket.Object(keyName)
 
-	f, err := os.Open(srcPath)
-	if err != nil {
-		return err
+	// cancelling the context abandons the write, so returning early on an error
+	// leaves no partial object behind
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := object.NewWriter(ctx)
+	if uploadRec.Metadata != nil {
+		writer.ContentType = uploadRec.Metadata.ContentType
+		writer.CacheControl = uploadRec.Metadata.CacheControl
+		writer.StorageClass = uploadRec.Metadata.StorageClass
+		writer.Metadata = make(map[string]string, len(uploadRec.Metadata.Custom)+1)
+		for key, value := range uploadRec.Metadata.Custom {
+			writer.Metadata[key] = value
+		}
 	}
-	defer f.Close()
 
-	writer := object.NewWriter(ctx)
-	_, err = io.Copy(writer, f)
-	if err != nil {
-		return err
+	if uploadRec.SymlinkTarget != "" {
+		// record where the link points to rather than its content
+		if writer.Metadata == nil {
+			writer.Metadata = make(map[string]string, 1)
+		}
+		writer.Metadata[SymlinkTargetMetadataKey] = uploadRec.SymlinkTarget
+	} else {
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var dst io.Writer = writer
+		var compressor io.WriteCloser
+		if uploadRec.ContentEncoding != "" {
+			writer.ContentEncoding = uploadRec.ContentEncoding
+			if writer.ContentType == "" {
+				writer.ContentType = contentType(srcPath)
+			}
+			compressor, err = newCompressor(writer, uploadRec.ContentEncoding)
+			if err != nil {
+				return err
+			}
+			dst = compressor
+		}
+
+		_, err = io.Copy(dst, f)
+		if err == nil && compressor != nil {
+			err = compressor.Close()
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	err = writer.Close()
+	err := writer.Close()
 	if err != nil {
 		return err
 	}
 
-	return err
+	attrs := writer.Attrs()
+	uploadRec.Size = attrs.Size
+	uploadRec.MD5 = hex.EncodeToString(attrs.MD5)
+	uploadRec.Generation = attrs.Generation
+
+	return nil
 }
 
 func (d *Downloader) Upload(uploads []*Upload) error {
 	ctx := context.Background()
 
 	for _, uploadRec := range uploads {
-		err := upload(ctx, d.client, path.Join(d.workdir, uploadRec.SourcePath), uploadRec.DestinationURL)
+		err := upload(ctx, d.client, path.Join(d.workdir, uploadRec.SourcePath), uploadRec)
 		if err != nil {
 			return err
 		}
@@ -152,6 +215,30 @@ func (d *Downloader) Upload(uploads []*Upload) error {
 	return nil
 }
 
+// DownloadSizes looks up the size of the object behind each download
+func (d *Downloader) DownloadSizes(downloads []*Download) ([]int64, error) {
+	ctx := context.Background()
+
+	sizes := make([]int64, len(downloads))
+	for i, download := range downloads {
+		size, err := objectSize(ctx, d.client, download.SourceURL)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = size
+	}
+	return sizes, nil
+}
+
+func objectSize(ctx context.Context, client *storage.Client, url string) (int64, error) {
+	bucketName, keyName := splitGSCPath(url)
+	attrs, err := client.Bucket(bucketName).Object(keyName).Attrs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not get the size of %s: %s", url, err)
+	}
+	return attrs.Size, nil
+}
+
 func (d *Downloader) Prepare(downloads []*Download) error {
 	ctx := context.Background()
 
@@ -225,6 +312,29 @@ func (d *GCSMounter) WasLocalized(p string) bool {
 	return false
 }
 
+// DownloadSizes only counts the downloads which are copied out of the mounted
+// buckets, as symlinks take no space in the work directory
+func (d *GCSMounter) DownloadSizes(downloads []*Download) ([]int64, error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	sizes := make([]int64, len(downloads))
+	for i, download := range downloads {
+		if download.SymlinkSafe {
+			continue
+		}
+		sizes[i], err = objectSize(ctx, client, download.SourceURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
 func (d *GCSMounter) Prepare(downloads []*Download) error {
 	// determine the unique bucket names
 	buckets := make(map[string]bool)
@@ -272,7 +382,7 @@ func (d *GCSMounter) Prepare(downloads []*Download) error {
 			}
 		} else {
 			log.Printf("Copying %s -> %s", src, dest)
-			err := copyFile(src, dest)
+			err := copyFile(src, dest, download.Decompress)
 			if err != nil {
 				panic(err)
 			}
@@ -289,12 +399,24 @@ func (d *GCSMounter) Prepare(downloads []*Download) error {
 	return nil
 }
 
-func copyFile(src string, dest string) error {
-	r, err := os.Open(src)
+// copyFile copies src to dest, decompressing it if decompress is set
+func copyFile(src string, dest string, decompress string) error {
+	f, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	defer f.Close()
+
+	var r io.Reader = f
+	if decompress != "" {
+		decompressor, err := newDecompressor(f, decompress)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		r = decompressor
+	}
+
 	w, err := os.Create(dest)
 	if err != nil {
 		return err
@@ -351,7 +473,7 @@ func (d *GCSMounter) Upload(uploads []*Upload) error {
 	}
 
 	for _, uploadRec := range uploads {
-		err := upload(ctx, client, path.Join(d.workdir, uploadRec.SourcePath), uploadRec.DestinationURL)
+		err := upload(ctx, client, path.Join(d.workdir, uploadRec.SourcePath), uploadRec)
 		if err != nil {
 			return err
 		}
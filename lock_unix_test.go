@@ -0,0 +1,41 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// isLocked reports whether the lock on filename is held, whether by this
+// process or another one. A file which doesn't exist isn't locked.
+func isLocked(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == syscall.EWOULDBLOCK
+}
+
+func TestJobRootLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	jobRoot, err := NewJobRoot(dir, "")
+	require.Nil(t, err)
+	assert.True(t, isLocked(path.Join(jobRoot.Path, jobRootMarker)))
+	_, err = lockFile(path.Join(jobRoot.Path, jobRootMarker))
+	assert.NotNil(t, err)
+
+	require.Nil(t, jobRoot.Cleanup(CleanupKeep, StatusSuccess))
+	assert.False(t, isLocked(path.Join(jobRoot.Path, jobRootMarker)))
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pgm/shepherd"
 	"github.com/spf13/cobra"
@@ -15,61 +23,559 @@ import (
 const DownloadStrategy = "download"
 const GCSFuseStrategy = "gcsfuse"
 
-func execShepherd(filename string, strategy string) {
-	p := shepherd.Parameters{}
+// version is set at build time via -ldflags "-X main.version=..."
+var version = "dev"
 
+// paramsFormat overrides the format of parameter files, which is otherwise
+// picked from their extension
+var paramsFormat string
+
+func readParameters(filename string) (*shepherd.Parameters, error) {
 	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	format := paramsFormat
+	if format == "" {
+		format = shepherd.ParamsFormatForFile(filename)
 	}
 
-	json.Unmarshal(buf, &p)
+	p, err := shepherd.LoadParameters(buf, format)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	return p, nil
+}
+
+// transferFactory returns how jobs localize their inputs and upload their outputs
+func transferFactory(strategy string) (shepherd.TransferFactory, error) {
+	switch strategy {
+	case DownloadStrategy:
+		return func(jobRoot string, workDir string) (shepherd.Localizer, shepherd.Uploader) {
+			l := shepherd.NewDownloader(workDir)
+			return l, l
+		}, nil
+	case GCSFuseStrategy:
+		return func(jobRoot string, workDir string) (shepherd.Localizer, shepherd.Uploader) {
+			l := shepherd.NewGCSMounter(jobRoot, workDir)
+			return l, l
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q, expected %q or %q", strategy, DownloadStrategy, GCSFuseStrategy)
+}
+
+// execShepherd runs a job in a new directory within workRoot, named
+// workdirName if set, which is then removed according to cleanup. SIGTERM and
+// SIGINT are forwarded to the command and the job is marked preempted, with
+// its logs uploaded within preemptionDeadline. A second signal, or the
+// deadline passing, exits straight away.
+func execShepherd(filename string, strategy string, workRoot string, workdirName string, cleanup string, preemptionDeadline time.Duration) error {
+	newTransfer, err := transferFactory(strategy)
+	if err != nil {
+		return err
+	}
+	err = shepherd.ValidateCleanupPolicy(cleanup)
+	if err != nil {
+		return err
+	}
+
+	p, err := readParameters(filename)
+	if err != nil {
+		return err
+	}
 
-	rootDir, err := ioutil.TempDir(".", "tmp-work-")
+	jobRoot, err := shepherd.NewJobRoot(workRoot, workdirName)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	rootDir := jobRoot.Path
 	workDir := path.Join(rootDir, "work")
 
 	log.Printf("Executing job in new directory: %s", workDir)
 
-	var localizer shepherd.Localizer
-	var uploader shepherd.Uploader
+	preemption := shepherd.NewPreemption(preemptionDeadline)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s", sig)
+			preemption.Preempt(sig)
+		case <-done:
+			return
+		}
+		// downloads and uploads can't be interrupted, so give up on them
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s again, exiting", sig)
+		case <-preemption.Expired():
+			log.Printf("Did not stop within %s of being preempted, exiting", preemptionDeadline)
+		case <-done:
+			return
+		}
+		os.Exit(1)
+	}()
 
-	if strategy == DownloadStrategy {
-		l := shepherd.NewDownloader(workDir)
-		localizer = l
-		uploader = l
-	} else if strategy == GCSFuseStrategy {
-		l := shepherd.NewGCSMounter(rootDir, workDir)
-		localizer = l
-		uploader = l
-	} else {
-		panic("unknown strategy")
+	localizer, uploader := newTransfer(rootDir, workDir)
+	results, err := shepherd.ExecutePreemptible(context.Background(), workDir, workDir, p, localizer, uploader, preemption)
+	cleanupErr := jobRoot.Cleanup(cleanup, results.Status)
+	if cleanupErr != nil {
+		log.Printf("Warning: Could not remove %s: %s", rootDir, cleanupErr)
 	}
+	return err
+}
+
+// gcShepherd removes the job directories within workRoot which haven't
+// changed for olderThan, skipping those of running jobs
+func gcShepherd(workRoot string, olderThan time.Duration, dryRun bool) error {
+	removed, err := shepherd.CollectGarbage(workRoot, olderThan, dryRun)
+	for _, jobRoot := range removed {
+		fmt.Println(jobRoot)
+	}
+	return err
+}
 
-	err = shepherd.Execute(workDir, workDir, &p, localizer, uploader)
+// batchShepherd runs every job in a JSONL file ("-" for stdin), writing a
+// summary line for each to summaryPath (stdout if empty). On SIGTERM or
+// SIGINT, running jobs are cancelled and no more are started.
+func batchShepherd(filename string, strategy string, workRoot string, cleanup string, concurrency int, summaryPath string) error {
+	newTransfer, err := transferFactory(strategy)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	err = shepherd.ValidateCleanupPolicy(cleanup)
+	if err != nil {
+		return err
+	}
+
+	var jobs io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		jobs = f
 	}
+
+	var summary io.Writer = os.Stdout
+	if summaryPath != "" {
+		f, err := os.Create(summaryPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		summary = f
+	}
+
+	ctx, stop := stopOnSignal()
+	defer stop()
+
+	batch := &shepherd.Batch{WorkRoot: workRoot, Concurrency: concurrency, Cleanup: cleanup, NewTransfer: newTransfer}
+	failed, err := batch.Run(ctx, jobs, summary)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d jobs did not succeed", failed)
+	}
+	return nil
 }
 
-func main() {
+// workerShepherd runs the jobs dropped into a spool directory until it
+// receives SIGTERM or SIGINT, at which point it stops once the current job completes
+func workerShepherd(spoolDir string, strategy string, workRoot string, cleanup string, pollInterval time.Duration) error {
+	newTransfer, err := transferFactory(strategy)
+	if err != nil {
+		return err
+	}
+	err = shepherd.ValidateCleanupPolicy(cleanup)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := stopOnSignal()
+	defer stop()
+
+	worker := &shepherd.Worker{Spool: &shepherd.Spool{Dir: spoolDir},
+		WorkRoot:     workRoot,
+		PollInterval: pollInterval,
+		Cleanup:      cleanup,
+		NewTransfer:  newTransfer}
+	return worker.Run(ctx)
+}
+
+// consumeShepherd runs the jobs received from a Pub/Sub subscription until it
+// receives SIGTERM or SIGINT, at which point it stops once the current job completes
+func consumeShepherd(subscription string, completionTopic string, strategy string, workRoot string, cleanup string, ackDeadline time.Duration) error {
+	if ackDeadline < shepherd.MinPubSubAckDeadline || ackDeadline > shepherd.MaxPubSubAckDeadline {
+		return fmt.Errorf("--ack-deadline must be between %s and %s, not %s",
+			shepherd.MinPubSubAckDeadline, shepherd.MaxPubSubAckDeadline, ackDeadline)
+	}
+	newTransfer, err := transferFactory(strategy)
+	if err != nil {
+		return err
+	}
+	err = shepherd.ValidateCleanupPolicy(cleanup)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := stopOnSignal()
+	defer stop()
+
+	queue, err := shepherd.NewPubSubQueue(ctx, subscription, completionTopic)
+	if err != nil {
+		return err
+	}
+	worker := &shepherd.QueueWorker{Queue: queue,
+		WorkRoot:    workRoot,
+		AckDeadline: ackDeadline,
+		Cleanup:     cleanup,
+		NewTransfer: newTransfer}
+	return worker.Run(ctx)
+}
+
+// stopOnSignal returns a context which is cancelled on SIGTERM or SIGINT
+func stopOnSignal() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, stopping", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// serveShepherd runs jobs submitted over HTTP on addr until it receives
+// SIGTERM or SIGINT, at which point it stops accepting requests and cancels
+// the running jobs. Requests must present token, or if that's empty the
+// value of SHEPHERD_TOKEN.
+func serveShepherd(addr string, stateDir string, strategy string, workRoot string, cleanup string, concurrency int, token string) error {
+	if token == "" {
+		token = os.Getenv("SHEPHERD_TOKEN")
+	}
+	if token == "" {
+		return errors.New("a token is required, either from --token or SHEPHERD_TOKEN")
+	}
+	newTransfer, err := transferFactory(strategy)
+	if err != nil {
+		return err
+	}
+
+	err = shepherd.ValidateCleanupPolicy(cleanup)
+	if err != nil {
+		return err
+	}
+
+	server, err := shepherd.NewServer(stateDir, workRoot, concurrency, cleanup, token, newTransfer)
+	if err != nil {
+		return err
+	}
+	defer server.Stop()
+
+	ctx, stop := stopOnSignal()
+	defer stop()
+	httpServer := &http.Server{Addr: addr, Handler: server.Handler()}
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdown <- httpServer.Shutdown(context.Background())
+	}()
 
+	log.Printf("Listening on %s", addr)
+	err = httpServer.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
+}
+
+func validateShepherd(filename string) error {
+	p, err := readParameters(filename)
+	if err != nil {
+		return err
+	}
+
+	err = shepherd.ValidateParameters(p)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid\n", filename)
+	return nil
+}
+
+func planShepherd(filename string, asJSON bool) error {
+	p, err := readParameters(filename)
+	if err != nil {
+		return err
+	}
+
+	plan, err := shepherd.NewPlan(p)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		b, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	printPlan(os.Stdout, plan)
+	return nil
+}
+
+func printPlan(w io.Writer, plan *shepherd.Plan) {
+	fmt.Fprintf(w, "Downloads:\n")
+	if len(plan.Downloads) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+	}
+	for _, download := range plan.Downloads {
+		var notes []string
+		if download.Extract {
+			notes = append(notes, "extract")
+		}
+		if download.Decompress != "" {
+			notes = append(notes, "decompress "+download.Decompress)
+		}
+		if download.Executable {
+			notes = append(notes, "executable")
+		}
+		fmt.Fprintf(w, "  %s -> %s", download.SourceURL, download.DestinationPath)
+		if len(notes) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(notes, ", "))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintf(w, "Command:\n  %s\n", strings.Join(plan.Command, " "))
+	if plan.DockerImage != "" {
+		fmt.Fprintf(w, "  in docker image %s\n", plan.DockerImage)
+	}
+	if plan.WorkingPath != "" {
+		fmt.Fprintf(w, "  in %s\n", plan.WorkingPath)
+	}
+
+	printUploadRules(w, "Uploads on success:", plan.UploadRules)
+	printUploadRules(w, "Uploads on failure:", plan.FailureUploadRules)
+}
+
+func printUploadRules(w io.Writer, title string, rules []*shepherd.UploadPatterns) {
+	fmt.Fprintf(w, "%s\n", title)
+	if len(rules) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+	}
+	for _, rule := range rules {
+		patterns := make([]string, 0, len(rule.Filters))
+		for _, filter := range rule.Filters {
+			pattern := filter.Pattern
+			if pattern == "" {
+				pattern = "/" + filter.Regex + "/"
+			}
+			if filter.Exclude {
+				pattern = "exclude " + pattern
+			}
+			patterns = append(patterns, pattern)
+		}
+		fmt.Fprintf(w, "  %s -> %s", strings.Join(patterns, ", "), rule.DestinationURLPrefix)
+		if rule.Archive != nil {
+			fmt.Fprintf(w, " (as %s archive)", rule.Archive.Format)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+// defaultPreemptionDeadline is how long a job gets to stop once sent SIGTERM
+// or SIGINT, leaving a margin within the 30s given to preempted VMs
+const defaultPreemptionDeadline = 25 * time.Second
+
+// newRootCmd builds the shepherd command and its subcommands
+func newRootCmd() *cobra.Command {
+	var strategy string
+	var workRoot string
+	var workdirName string
+	var cleanup string
+	var preemptionDeadline time.Duration
 	var rootCmd = &cobra.Command{
-		Use:   "shepherd",
-		Short: "shepherd is a tool for executing a command where inputs are localized from GCS and then uploaded afterwards",
+		Use:          "shepherd",
+		Short:        "shepherd is a tool for executing a command where inputs are localized from GCS and then uploaded afterwards",
+		SilenceUsage: true,
+		// before there were subcommands, the parameters file was the only argument
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			log.Printf("Warning: \"shepherd PARAMS_FILE\" is deprecated, use \"shepherd run PARAMS_FILE\" instead")
+			return execShepherd(args[0], strategy, ".", "", shepherd.CleanupKeep, defaultPreemptionDeadline)
+		},
+	}
+	rootCmd.PersistentFlags().StringVar(&paramsFormat, "format", "", "format of the parameters file: \"json\", \"yaml\" or \"toml\" (defaults to its extension)")
+	rootCmd.Flags().StringVarP(&strategy, "strategy", "s", DownloadStrategy, "either \"download\" or \"gcsfuse\"")
+
+	var runCmd = &cobra.Command{
+		Use:   "run PARAMS_FILE",
+		Short: "Localize the inputs, run the command and upload its outputs",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return execShepherd(args[0], strategy, workRoot, workdirName, cleanup, preemptionDeadline)
+		},
+	}
+	runCmd.Flags().StringVarP(&strategy, "strategy", "s", DownloadStrategy, "either \"download\" or \"gcsfuse\"")
+	runCmd.Flags().StringVar(&workRoot, "work-root", ".", "directory to create the job's directory in")
+	runCmd.Flags().StringVar(&workdirName, "workdir-name", "", "name of the job's directory, instead of a new tmp-work-* name")
+	runCmd.Flags().StringVar(&cleanup, "cleanup", shepherd.CleanupKeep, "either \"keep\", \"delete-on-success\" or \"delete-always\"")
+	runCmd.Flags().DurationVar(&preemptionDeadline, "preemption-deadline", defaultPreemptionDeadline, "once sent SIGTERM or SIGINT, how long to allow for stopping the command and uploading logs")
+
+	var concurrency int
+	var summaryPath string
+	var batchCmd = &cobra.Command{
+		Use:   "batch JOBS_FILE",
+		Short: "Run every job of a JSONL file of parameters (\"-\" reads from stdin)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return batchShepherd(args[0], strategy, workRoot, cleanup, concurrency, summaryPath)
+		},
+	}
+	batchCmd.Flags().StringVarP(&strategy, "strategy", "s", DownloadStrategy, "either \"download\" or \"gcsfuse\"")
+	batchCmd.Flags().StringVar(&workRoot, "work-root", ".", "directory to create the directories of jobs in")
+	batchCmd.Flags().StringVar(&cleanup, "cleanup", shepherd.CleanupKeep, "either \"keep\", \"delete-on-success\" or \"delete-always\"")
+	batchCmd.Flags().IntVarP(&concurrency, "concurrency", "j", 1, "number of jobs to run at once")
+	batchCmd.Flags().StringVar(&summaryPath, "summary", "", "write a JSONL summary of the jobs to this file instead of stdout")
+
+	var pollInterval time.Duration
+	var workerCmd = &cobra.Command{
+		Use:   "worker SPOOL_DIR",
+		Short: "Run the jobs dropped into SPOOL_DIR/incoming until terminated",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return workerShepherd(args[0], strategy, workRoot, cleanup, pollInterval)
+		},
+	}
+	workerCmd.Flags().StringVarP(&strategy, "strategy", "s", DownloadStrategy, "either \"download\" or \"gcsfuse\"")
+	workerCmd.Flags().StringVar(&workRoot, "work-root", ".", "directory to create the directories of jobs in")
+	workerCmd.Flags().StringVar(&cleanup, "cleanup", shepherd.CleanupKeep, "either \"keep\", \"delete-on-success\" or \"delete-always\"")
+	workerCmd.Flags().DurationVar(&pollInterval, "poll-interval", 5*time.Second, "how often to check for new jobs")
+
+	var completionTopic string
+	var ackDeadline time.Duration
+	var consumeCmd = &cobra.Command{
+		Use:   "consume projects/PROJECT/subscriptions/NAME",
+		Short: "Run the jobs received from a Pub/Sub subscription until terminated",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return consumeShepherd(args[0], completionTopic, strategy, workRoot, cleanup, ackDeadline)
+		},
+	}
+	consumeCmd.Flags().StringVarP(&strategy, "strategy", "s", DownloadStrategy, "either \"download\" or \"gcsfuse\"")
+	consumeCmd.Flags().StringVar(&workRoot, "work-root", ".", "directory to create the directories of jobs in")
+	consumeCmd.Flags().StringVar(&cleanup, "cleanup", shepherd.CleanupKeep, "either \"keep\", \"delete-on-success\" or \"delete-always\"")
+	consumeCmd.Flags().StringVar(&completionTopic, "completion-topic", "", "topic to publish results to, as projects/PROJECT/topics/NAME")
+	consumeCmd.Flags().DurationVar(&ackDeadline, "ack-deadline", time.Minute, "how far to extend the deadline of a message while its job runs, from 10s to 10m")
+	consumeCmd.MarkFlagRequired("completion-topic")
+
+	var addr string
+	var token string
+	var stateDir string
+	var serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Run jobs submitted over HTTP",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return serveShepherd(addr, stateDir, strategy, workRoot, cleanup, concurrency, token)
+		},
+	}
+	serveCmd.Flags().StringVarP(&strategy, "strategy", "s", DownloadStrategy, "either \"download\" or \"gcsfuse\"")
+	serveCmd.Flags().StringVar(&workRoot, "work-root", ".", "directory to create the directories of jobs in")
+	serveCmd.Flags().StringVar(&cleanup, "cleanup", shepherd.CleanupKeep, "either \"keep\", \"delete-on-success\" or \"delete-always\"")
+	serveCmd.Flags().IntVarP(&concurrency, "concurrency", "j", 1, "number of jobs to run at once")
+	serveCmd.Flags().StringVar(&addr, "addr", "127.0.0.1:8080", "address to listen on")
+	serveCmd.Flags().StringVar(&token, "token", "", "bearer token which requests must present (defaults to $SHEPHERD_TOKEN, which keeps it out of the process list)")
+	serveCmd.Flags().StringVar(&stateDir, "state-dir", "shepherd-state", "directory where the state of submitted jobs is kept")
+
+	// unlike the other commands, gc has no default work root
+	var gcWorkRoot string
+	var olderThan time.Duration
+	var dryRun bool
+	var gcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Remove the job directories within the work root which haven't changed for a while",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return gcShepherd(gcWorkRoot, olderThan, dryRun)
+		},
+	}
+	gcCmd.Flags().StringVar(&gcWorkRoot, "work-root", "", "directory containing the directories of jobs")
+	gcCmd.Flags().DurationVar(&olderThan, "older-than", 24*time.Hour, "only remove directories which haven't changed for this long")
+	gcCmd.Flags().BoolVar(&dryRun, "dry-run", false, "list the directories which would be removed without removing them")
+	gcCmd.MarkFlagRequired("work-root")
+
+	var validateCmd = &cobra.Command{
+		Use:   "validate PARAMS_FILE",
+		Short: "Check the parameters without running anything",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return validateShepherd(args[0])
+		},
+	}
+
+	var asJSON bool
+	var planCmd = &cobra.Command{
+		Use:   "plan PARAMS_FILE",
+		Short: "Show what would be downloaded, executed and uploaded",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return planShepherd(args[0], asJSON)
+		},
+	}
+	planCmd.Flags().BoolVar(&asJSON, "json", false, "print the plan as JSON")
+
+	var versionCmd = &cobra.Command{
+		Use:   "version",
+		Short: "Print the version of shepherd",
+		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			var strategy string
-			cmd.LocalFlags().StringVarP(&strategy, "strategy", "s", DownloadStrategy, "either \"download\" or \"gcsfuse\"")
-			execShepherd(args[0], strategy)
+			fmt.Println(version)
 		},
 	}
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	var schemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of parameter files",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schema, err := shepherd.ParametersSchema()
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(schema))
+			return nil
+		},
 	}
 
+	rootCmd.AddCommand(runCmd, batchCmd, workerCmd, consumeCmd, serveCmd, gcCmd, validateCmd, planCmd, versionCmd, schemaCmd)
+	return rootCmd
+}
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunDefaultWorkRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// enough for a storage client to be created, which never needs a token
+	// as the job downloads and uploads nothing
+	credentials := path.Join(dir, "credentials.json")
+	require.Nil(t, ioutil.WriteFile(credentials, []byte(`{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`), 0644))
+	defer func(orig string) { os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", orig) }(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentials)
+
+	require.Nil(t, ioutil.WriteFile(path.Join(dir, "params.json"), []byte(`{"command": ["true"]}`), 0644))
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	defer os.Chdir(wd)
+	require.Nil(t, os.Chdir(dir))
+
+	cmd := newRootCmd()
+	cmd.SetArgs([]string{"run", "params.json"})
+	require.Nil(t, cmd.Execute())
+
+	jobRoots, err := filepath.Glob(path.Join(dir, "tmp-work-*"))
+	require.Nil(t, err)
+	assert.Len(t, jobRoots, 1)
+}
@@ -0,0 +1,49 @@
+package shepherd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path"
+)
+
+// ManifestName is the name of the manifest uploaded alongside the outputs,
+// under the DestinationURLPrefix of every upload rule. It is written within
+// shepherdDir so that it's never mistaken for an output.
+const ManifestName = "shepherd-manifest.json"
+
+// Manifest records where every output of a job was uploaded to, along with
+// the inputs which were localized before running the command.
+type Manifest struct {
+	Uploads   []*Upload   `json:"uploads"`
+	Downloads []*Download `json:"downloads"`
+}
+
+// uploadManifest writes a manifest describing the completed uploads and
+// uploads it next to the outputs.
+func uploadManifest(workdir string, destinationURLPrefix string, uploads []*Upload, downloads []*Download, job map[string]string, uploader Uploader) error {
+	if downloads == nil {
+		downloads = []*Download{}
+	}
+	manifest := &Manifest{Uploads: uploads, Downloads: downloads}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	manifestPath := path.Join(shepherdDir, ManifestName)
+	err = ensureParentDirExists(path.Join(workdir, manifestPath))
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(workdir, manifestPath), b, 0644)
+	if err != nil {
+		return err
+	}
+
+	manifestUpload := &Upload{SourcePath: manifestPath, DestinationURL: joinURL(destinationURLPrefix, ManifestName)}
+	manifestUpload.Metadata = (*ObjectMetadata)(nil).forUpload(manifestUpload, job)
+	log.Printf("Uploading manifest to %s", manifestUpload.DestinationURL)
+	return uploader.Upload([]*Upload{manifestUpload})
+}
@@ -0,0 +1,111 @@
+package shepherd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Custom metadata keys which shepherd adds to every uploaded object, so that
+// outputs can be traced back to the job which produced them
+const (
+	JobIDMetadataKey         = "shepherd-job-id"
+	CommandMetadataKey       = "shepherd-command"
+	CommandDigestMetadataKey = "shepherd-command-sha256"
+)
+
+// maxCommandMetadataBytes keeps the command well within the 8 KiB that GCS
+// allows for all of an object's custom metadata. Longer commands are
+// truncated, and identified by the digest of the whole command instead.
+const maxCommandMetadataBytes = 1024
+
+// reservedMetadataPrefix is used by shepherd's own metadata keys
+const reservedMetadataPrefix = "shepherd-"
+
+// ObjectMetadata sets the attributes of uploaded objects. When ContentType is
+// empty, it is detected from the file's extension.
+type ObjectMetadata struct {
+	ContentType  string            `json:"content_type"`
+	CacheControl string            `json:"cache_control"`
+	StorageClass string            `json:"storage_class"`
+	Custom       map[string]string `json:"custom"`
+}
+
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE", "MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY"}
+
+func validateObjectMetadata(metadata *ObjectMetadata) error {
+	if metadata.StorageClass != "" {
+		known := false
+		for _, storageClass := range storageClasses {
+			known = known || metadata.StorageClass == storageClass
+		}
+		if !known {
+			return fmt.Errorf("unknown storage class %q, expected one of %s", metadata.StorageClass, strings.Join(storageClasses, ", "))
+		}
+	}
+	for key := range metadata.Custom {
+		if key == "" {
+			return fmt.Errorf("custom metadata keys must not be empty")
+		}
+		if strings.HasPrefix(key, reservedMetadataPrefix) {
+			return fmt.Errorf("custom metadata key %q must not start with %q, which is reserved", key, reservedMetadataPrefix)
+		}
+	}
+	return nil
+}
+
+// jobMetadata returns the custom metadata identifying the job
+func jobMetadata(params *Parameters) map[string]string {
+	metadata := make(map[string]string, 2)
+	if params.JobID != "" {
+		metadata[JobIDMetadataKey] = params.JobID
+	}
+	var command strings.Builder
+	encoder := json.NewEncoder(&command)
+	encoder.SetEscapeHTML(false)
+	if encoder.Encode(params.Command) == nil {
+		encoded := strings.TrimSuffix(command.String(), "\n")
+		if len(encoded) > maxCommandMetadataBytes {
+			digest := sha256.Sum256([]byte(encoded))
+			metadata[CommandDigestMetadataKey] = hex.EncodeToString(digest[:])
+			encoded = truncateUTF8(encoded, maxCommandMetadataBytes-len("...")) + "..."
+		}
+		metadata[CommandMetadataKey] = encoded
+	}
+	return metadata
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// forUpload resolves the attributes to write for uploadRec, which are those
+// of the upload rule (metadata may be nil) along with the job's own metadata.
+func (metadata *ObjectMetadata) forUpload(uploadRec *Upload, job map[string]string) *ObjectMetadata {
+	resolved := &ObjectMetadata{Custom: make(map[string]string)}
+	if metadata != nil {
+		resolved.ContentType = metadata.ContentType
+		resolved.CacheControl = metadata.CacheControl
+		resolved.StorageClass = metadata.StorageClass
+		for key, value := range metadata.Custom {
+			resolved.Custom[key] = value
+		}
+	}
+	if resolved.ContentType == "" && uploadRec.SymlinkTarget == "" {
+		resolved.ContentType = contentType(uploadRec.SourcePath)
+	}
+	for key, value := range job {
+		resolved.Custom[key] = value
+	}
+	return resolved
+}
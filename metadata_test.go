@@ -0,0 +1,71 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadMetadata(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		JobID: "job-1",
+		UploadRules: []*UploadPatterns{
+			{Filters: []*Filter{{Pattern: "*.bin"}},
+				DestinationURLPrefix: "gs://mock/out",
+				Metadata: &ObjectMetadata{ContentType: "application/x-custom",
+					CacheControl: "no-cache",
+					StorageClass: "NEARLINE",
+					Custom:       map[string]string{"owner": "me"}}},
+			{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://mock/out"},
+		},
+		Command: []string{"bash", "-c", "echo -n a > a.bin && echo -n b > b.json"}}
+
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.Nil(t, err)
+
+	job := map[string]string{JobIDMetadataKey: "job-1", CommandMetadataKey: `["bash","-c","echo -n a > a.bin && echo -n b > b.json"]`}
+	custom := map[string]string{"owner": "me"}
+	for key, value := range job {
+		custom[key] = value
+	}
+	assert.Equal(t, &ObjectMetadata{ContentType: "application/x-custom",
+		CacheControl: "no-cache",
+		StorageClass: "NEARLINE",
+		Custom:       custom},
+		uploader.metadata["gs://mock/out/a.bin"])
+	assert.Equal(t, &ObjectMetadata{ContentType: "application/json", Custom: job},
+		uploader.metadata["gs://mock/out/b.json"])
+	assert.Equal(t, &ObjectMetadata{ContentType: "application/json", Custom: job},
+		uploader.metadata["gs://mock/out/"+ManifestName])
+}
+
+func TestValidateObjectMetadata(t *testing.T) {
+	assert.Nil(t, validateObjectMetadata(&ObjectMetadata{StorageClass: "COLDLINE", Custom: map[string]string{"a": "b"}}))
+	assert.NotNil(t, validateObjectMetadata(&ObjectMetadata{StorageClass: "FROZEN"}))
+	assert.NotNil(t, validateObjectMetadata(&ObjectMetadata{Custom: map[string]string{JobIDMetadataKey: "x"}}))
+}
+
+func TestLongCommandMetadata(t *testing.T) {
+	long := strings.Repeat("é", maxCommandMetadataBytes)
+	metadata := jobMetadata(&Parameters{Command: []string{"echo", long}})
+	command := metadata[CommandMetadataKey]
+	assert.True(t, len(command) <= maxCommandMetadataBytes, "%d bytes", len(command))
+	assert.True(t, utf8.ValidString(command))
+	assert.True(t, strings.HasPrefix(command, `["echo","éé`))
+	assert.True(t, strings.HasSuffix(command, "..."))
+	assert.Equal(t, 64, len(metadata[CommandDigestMetadataKey]))
+
+	metadata = jobMetadata(&Parameters{Command: []string{"true"}})
+	assert.Equal(t, `["true"]`, metadata[CommandMetadataKey])
+	assert.NotContains(t, metadata, CommandDigestMetadataKey)
+}
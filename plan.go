@@ -0,0 +1,33 @@
+package shepherd
+
+// Plan describes what Execute would do with a set of parameters, without
+// localizing, running or uploading anything.
+type Plan struct {
+	Downloads   []*Download `json:"downloads"`
+	DockerImage string      `json:"docker_image,omitempty"`
+	Command     []string    `json:"command"`
+	WorkingPath string      `json:"working_path,omitempty"`
+	// UploadRules apply when the command succeeds, and FailureUploadRules
+	// when it fails
+	UploadRules        []*UploadPatterns `json:"upload_rules"`
+	FailureUploadRules []*UploadPatterns `json:"failure_upload_rules"`
+}
+
+// NewPlan validates params and returns the plan for executing them
+func NewPlan(params *Parameters) (*Plan, error) {
+	err := validateParameters(params)
+	if err != nil {
+		return nil, err
+	}
+
+	downloads := params.Downloads
+	if downloads == nil {
+		downloads = []*Download{}
+	}
+	return &Plan{Downloads: downloads,
+		DockerImage:        params.DockerImage,
+		Command:            params.Command,
+		WorkingPath:        params.WorkingPath,
+		UploadRules:        params.uploadRules(),
+		FailureUploadRules: params.failureUploadRules()}, nil
+}
@@ -0,0 +1,29 @@
+package shepherd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPlan(t *testing.T) {
+	params := &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://bucket/out"},
+		Downloads: []*Download{{SourceURL: "gs://bucket/in",
+			DestinationPath: "in"}},
+		Command:   []string{"cp", "in", "out"},
+		OnFailure: &FailureUploads{DestinationURLPrefix: "gs://bucket/failed"}}
+
+	plan, err := NewPlan(params)
+	require.Nil(t, err)
+	assert.Equal(t, params.Downloads, plan.Downloads)
+	assert.Equal(t, []string{"cp", "in", "out"}, plan.Command)
+	require.Len(t, plan.UploadRules, 1)
+	assert.Equal(t, "gs://bucket/out", plan.UploadRules[0].DestinationURLPrefix)
+	require.Len(t, plan.FailureUploadRules, 1)
+	assert.Equal(t, "gs://bucket/failed", plan.FailureUploadRules[0].DestinationURLPrefix)
+
+	_, err = NewPlan(&Parameters{})
+	assert.NotNil(t, err)
+}
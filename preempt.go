@@ -0,0 +1,98 @@
+package shepherd
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Preemption tells a running job that the machine it runs on is going away.
+// Signals passed to Preempt are forwarded to the command, which has until
+// half of Deadline has passed since the first of them to exit before it is
+// killed. The job is then marked preempted and its logs and results are
+// uploaded. Downloads and uploads can't be interrupted, so the process should
+// exit once Expired is closed rather than wait for them.
+type Preemption struct {
+	Deadline  time.Duration
+	signals   chan os.Signal
+	preempted chan struct{}
+	expired   chan struct{}
+	once      sync.Once
+	// at is when the first signal arrived, only set once preempted is closed
+	at     time.Time
+	signal os.Signal
+}
+
+func NewPreemption(deadline time.Duration) *Preemption {
+	return &Preemption{Deadline: deadline,
+		signals:   make(chan os.Signal, 4),
+		preempted: make(chan struct{}),
+		expired:   make(chan struct{})}
+}
+
+// Preempt forwards sig to the running command, starting the deadline if it's
+// the first signal. It may be called from any goroutine.
+func (p *Preemption) Preempt(sig os.Signal) {
+	p.once.Do(func() {
+		p.at = time.Now()
+		p.signal = sig
+		close(p.preempted)
+		time.AfterFunc(p.Deadline, func() { close(p.expired) })
+	})
+	select {
+	case p.signals <- sig:
+	default:
+		log.Printf("Warning: Dropping %s, as earlier signals have yet to be forwarded", sig)
+	}
+}
+
+// Expired returns a channel which is closed once Deadline has passed since
+// the first signal
+func (p *Preemption) Expired() <-chan struct{} {
+	return p.expired
+}
+
+// isPreempted reports whether Preempt has been called, and is false for a
+// nil Preemption
+func (p *Preemption) isPreempted() bool {
+	if p == nil {
+		return false
+	}
+	select {
+	case <-p.preempted:
+		return true
+	default:
+		return false
+	}
+}
+
+// signalC returns the channel of signals to forward, which is nil, and so
+// never ready, for a nil Preemption
+func (p *Preemption) signalC() <-chan os.Signal {
+	if p == nil {
+		return nil
+	}
+	return p.signals
+}
+
+// killAfter returns how much longer the command may take to exit
+func (p *Preemption) killAfter() time.Duration {
+	return time.Until(p.at.Add(p.Deadline / 2))
+}
+
+// context returns a context which is also cancelled once preempted
+func (p *Preemption) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if p != nil {
+		go func() {
+			select {
+			case <-p.preempted:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
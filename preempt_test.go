@@ -0,0 +1,126 @@
+package shepherd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func preemptibleParams(script string) *Parameters {
+	return &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{{Pattern: "*"}},
+			DestinationURLPrefix: "gs://mock/out"},
+		Command:    []string{"sh", "-c", script},
+		StdoutPath: "stdout.txt",
+		StderrPath: "stderr.txt",
+		ResultPath: "result.json"}
+}
+
+// preemptOnceStarted sends SIGTERM once the command has created "started"
+func preemptOnceStarted(workDir string, preemption *Preemption) {
+	for i := 0; i < 500; i++ {
+		if _, err := os.Stat(path.Join(workDir, "started")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	preemption.Preempt(syscall.SIGTERM)
+}
+
+func TestPreemptionForwardsSignal(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := preemptibleParams(`trap 'kill $!; echo stopping; echo > got-term; exit 3' TERM; touch started; sleep 10 & wait`)
+	localizer := NewMockLocalizer(workDir)
+	uploader := NewMockUploader(workDir)
+	preemption := NewPreemption(10 * time.Second)
+	go preemptOnceStarted(workDir, preemption)
+
+	results, err := ExecutePreemptible(context.Background(), workDir, workDir, params, localizer, uploader, preemption)
+	require.NotNil(t, err)
+	assert.Equal(t, StatusPreempted, results.Status)
+	assert.True(t, results.Preempted)
+	assert.Equal(t, 3, results.ExitCode)
+	assert.FileExists(t, path.Join(workDir, "got-term"))
+
+	// only the logs and results are uploaded
+	outputs := uploadedOutputs(t, uploader)
+	assert.Equal(t, "stopping\n", outputs["gs://mock/out/stdout.txt"])
+	assert.Contains(t, outputs, "gs://mock/out/stderr.txt")
+	assert.Contains(t, outputs["gs://mock/out/result.json"], `"status":"preempted"`)
+	assert.Equal(t, 3, len(outputs))
+}
+
+func TestPreemptionKillsAfterDeadline(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := preemptibleParams(`trap '' TERM; touch started; exec sleep 10`)
+	preemption := NewPreemption(400 * time.Millisecond)
+	go preemptOnceStarted(workDir, preemption)
+
+	start := time.Now()
+	results, err := ExecutePreemptible(context.Background(), workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir), preemption)
+	require.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, StatusPreempted, results.Status)
+	assert.Equal(t, int(syscall.SIGKILL), results.Signal)
+}
+
+func TestPreemptionBeforeCommand(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := preemptibleParams(`touch ran`)
+	params.Downloads = []*Download{{SourceURL: "gs://mock/in", DestinationPath: "in"}}
+	localizer := NewMockLocalizer(workDir)
+	localizer.urlToContent["gs://mock/in"] = "input"
+	preemption := NewPreemption(time.Second)
+	preemption.Preempt(syscall.SIGINT)
+
+	results, err := ExecutePreemptible(context.Background(), workDir, workDir, params, localizer, NewMockUploader(workDir), preemption)
+	require.NotNil(t, err)
+	assert.Equal(t, StatusPreempted, results.Status)
+	assert.Equal(t, -1, results.ExitCode)
+	assert.False(t, localizer.WasLocalized("in"))
+	_, err = os.Stat(path.Join(workDir, "ran"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPreemptionAfterSuccess(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	// finishes successfully despite the signal
+	params := preemptibleParams(`trap 'kill $!; echo > out.txt; exit 0' TERM; touch started; sleep 10 & wait`)
+	uploader := NewMockUploader(workDir)
+	preemption := NewPreemption(10 * time.Second)
+	go preemptOnceStarted(workDir, preemption)
+
+	results, err := ExecutePreemptible(context.Background(), workDir, workDir, params, NewMockLocalizer(workDir), uploader, preemption)
+	require.Nil(t, err)
+	assert.Equal(t, StatusSuccess, results.Status)
+	assert.Contains(t, uploadedOutputs(t, uploader), "gs://mock/out/out.txt")
+}
+
+func TestPreemptionExpires(t *testing.T) {
+	preemption := NewPreemption(100 * time.Millisecond)
+	preemption.Preempt(syscall.SIGTERM)
+	select {
+	case <-preemption.Expired():
+	case <-time.After(5 * time.Second):
+		t.Fatal("preemption did not expire")
+	}
+}
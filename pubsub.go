@@ -0,0 +1,88 @@
+package shepherd
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"time"
+
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// Pub/Sub only accepts ack deadlines within this range
+const (
+	MinPubSubAckDeadline = 10 * time.Second
+	MaxPubSubAckDeadline = 600 * time.Second
+)
+
+// PubSubQueue is a Queue backed by a Google Cloud Pub/Sub subscription, with
+// completions published to a topic. Subscription and topic are full resource
+// names, such as "projects/my-project/subscriptions/jobs". When
+// PUBSUB_EMULATOR_HOST is set, the local emulator is used instead.
+type PubSubQueue struct {
+	service         *pubsub.Service
+	subscription    string
+	completionTopic string
+}
+
+// NewPubSubQueue connects to Pub/Sub with the application default
+// credentials, or without any when using the emulator
+func NewPubSubQueue(ctx context.Context, subscription string, completionTopic string) (*PubSubQueue, error) {
+	var options []option.ClientOption
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		options = append(options, option.WithEndpoint("http://"+host+"/"), option.WithoutAuthentication())
+	}
+
+	service, err := pubsub.NewService(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &PubSubQueue{service: service, subscription: subscription, completionTopic: completionTopic}, nil
+}
+
+func (q *PubSubQueue) Receive(ctx context.Context) (*QueueMessage, error) {
+	for ctx.Err() == nil {
+		resp, err := q.service.Projects.Subscriptions.Pull(q.subscription, &pubsub.PullRequest{MaxMessages: 1}).Context(ctx).Do()
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.ReceivedMessages) == 0 {
+			// the pull timed out without any messages arriving
+			continue
+		}
+
+		received := resp.ReceivedMessages[0]
+		data, err := base64.StdEncoding.DecodeString(received.Message.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &QueueMessage{ID: received.Message.MessageId,
+			Data:       data,
+			Attributes: received.Message.Attributes,
+			ackID:      received.AckId}, nil
+	}
+	return nil, nil
+}
+
+func (q *PubSubQueue) Extend(ctx context.Context, msg *QueueMessage, deadline time.Duration) error {
+	request := &pubsub.ModifyAckDeadlineRequest{AckIds: []string{msg.ackID}, AckDeadlineSeconds: int64(deadline / time.Second)}
+	_, err := q.service.Projects.Subscriptions.ModifyAckDeadline(q.subscription, request).Context(ctx).Do()
+	return err
+}
+
+func (q *PubSubQueue) Ack(ctx context.Context, msg *QueueMessage) error {
+	request := &pubsub.AcknowledgeRequest{AckIds: []string{msg.ackID}}
+	_, err := q.service.Projects.Subscriptions.Acknowledge(q.subscription, request).Context(ctx).Do()
+	return err
+}
+
+func (q *PubSubQueue) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	message := &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString(data), Attributes: attributes}
+	request := &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{message}}
+	_, err := q.service.Projects.Topics.Publish(q.completionTopic, request).Context(ctx).Do()
+	return err
+}
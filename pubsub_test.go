@@ -0,0 +1,79 @@
+package shepherd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// TestPubSubQueue runs a job through the Pub/Sub emulator, which can be
+// started with "gcloud beta emulators pubsub start" followed by
+// "$(gcloud beta emulators pubsub env-init)"
+func TestPubSubQueue(t *testing.T) {
+	if os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		t.Skip("PUBSUB_EMULATOR_HOST is not set")
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	project := fmt.Sprintf("projects/shepherd-test-%d", time.Now().UnixNano())
+	jobs := project + "/topics/jobs"
+	completions := project + "/topics/completions"
+	queue, err := NewPubSubQueue(ctx, project+"/subscriptions/jobs", completions)
+	require.Nil(t, err)
+
+	// a subscription to the completion topic to read the outcome from
+	service := queue.service
+	for _, topic := range []string{jobs, completions} {
+		_, err = service.Projects.Topics.Create(topic, &pubsub.Topic{}).Context(ctx).Do()
+		require.Nil(t, err)
+	}
+	_, err = service.Projects.Subscriptions.Create(project+"/subscriptions/jobs",
+		&pubsub.Subscription{Topic: jobs, AckDeadlineSeconds: 10}).Context(ctx).Do()
+	require.Nil(t, err)
+	_, err = service.Projects.Subscriptions.Create(project+"/subscriptions/completions",
+		&pubsub.Subscription{Topic: completions, AckDeadlineSeconds: 10}).Context(ctx).Do()
+	require.Nil(t, err)
+
+	job := &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString([]byte(`{"job_id": "emulated", "command": ["true"]}`))}
+	_, err = service.Projects.Topics.Publish(jobs, &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{job}}).Context(ctx).Do()
+	require.Nil(t, err)
+
+	worker := &QueueWorker{Queue: queue,
+		WorkRoot:    dir,
+		AckDeadline: MinPubSubAckDeadline,
+		NewTransfer: func(jobRoot string, workdir string) (Localizer, Uploader) {
+			return NewMockLocalizer(workdir), NewMockUploader(workdir)
+		}}
+	workerCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan error)
+	go func() { stopped <- worker.Run(workerCtx) }()
+
+	completionQueue := &PubSubQueue{service: service, subscription: project + "/subscriptions/completions"}
+	receiveCtx, cancelReceive := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelReceive()
+	msg, err := completionQueue.Receive(receiveCtx)
+	cancel()
+	require.Nil(t, <-stopped)
+	require.Nil(t, err)
+	require.NotNil(t, msg)
+	require.Nil(t, completionQueue.Ack(ctx, msg))
+
+	var completion QueueCompletion
+	require.Nil(t, json.Unmarshal(msg.Data, &completion))
+	assert.Equal(t, "emulated", completion.JobID)
+	assert.Equal(t, StatusSuccess, completion.Results.Status)
+	assert.Equal(t, StatusSuccess, msg.Attributes[CompletionStatusAttribute])
+}
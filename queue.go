@@ -0,0 +1,233 @@
+package shepherd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+// QueueMessage is a job received from a Queue
+type QueueMessage struct {
+	ID         string
+	Data       []byte
+	Attributes map[string]string
+	// ackID identifies this delivery of the message to the queue
+	ackID string
+}
+
+// Queue delivers jobs to workers, expecting each to be acknowledged before
+// its deadline passes, and accepts completion messages.
+type Queue interface {
+	// Receive waits for the next message, returning nil once ctx is cancelled
+	Receive(ctx context.Context) (*QueueMessage, error)
+	// Extend sets the deadline for acknowledging msg to deadline from now
+	Extend(ctx context.Context, msg *QueueMessage, deadline time.Duration) error
+	Ack(ctx context.Context, msg *QueueMessage) error
+	// Publish sends a message announcing the completion of a job
+	Publish(ctx context.Context, data []byte, attributes map[string]string) error
+}
+
+// QueueCompletion is the content of the message published once a job
+// received from a queue has run
+type QueueCompletion struct {
+	MessageID string   `json:"message_id"`
+	JobID     string   `json:"job_id,omitempty"`
+	Results   *Results `json:"results"`
+}
+
+// Attributes of completion messages
+const (
+	CompletionMessageIDAttribute = "message_id"
+	CompletionStatusAttribute    = "status"
+)
+
+// QueueWorker runs the jobs received from Queue one at a time, extending the
+// ack deadline of each message by AckDeadline while its job runs. Messages are
+// only acked once the completion is published, so a job may run twice.
+type QueueWorker struct {
+	Queue       Queue
+	WorkRoot    string
+	AckDeadline time.Duration
+	Cleanup     string
+	NewTransfer TransferFactory
+}
+
+// Run processes jobs until ctx is cancelled. A job which is already running
+// when that happens is allowed to complete.
+func (w *QueueWorker) Run(ctx context.Context) error {
+	for {
+		msg, err := w.Queue.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			log.Printf("Worker stopped")
+			return nil
+		}
+
+		log.Printf("Received message %s", msg.ID)
+		err = w.process(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *QueueWorker) process(msg *QueueMessage) error {
+	// a job which has started outlives the worker's context
+	ctx := context.Background()
+
+	// the subscription's own deadline may be far shorter than AckDeadline
+	w.extend(ctx, msg)
+	extending, stopExtending := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.extendDeadline(extending, msg)
+	}()
+
+	completion := w.runJob(msg)
+	stopExtending()
+	wg.Wait()
+	log.Printf("Job from message %s finished with status %s", msg.ID, completion.Results.Status)
+
+	b, err := json.Marshal(completion)
+	if err != nil {
+		return err
+	}
+	err = w.Queue.Publish(ctx, b, map[string]string{CompletionMessageIDAttribute: msg.ID,
+		CompletionStatusAttribute: completion.Results.Status})
+	if err != nil {
+		return fmt.Errorf("could not publish the completion of message %s: %s", msg.ID, err)
+	}
+	return w.Queue.Ack(ctx, msg)
+}
+
+// extendDeadline keeps pushing back the deadline of msg until ctx is cancelled
+func (w *QueueWorker) extendDeadline(ctx context.Context, msg *QueueMessage) {
+	for sleepContext(ctx, w.AckDeadline/2) {
+		w.extend(ctx, msg)
+	}
+}
+
+func (w *QueueWorker) extend(ctx context.Context, msg *QueueMessage) {
+	err := w.Queue.Extend(ctx, msg, w.AckDeadline)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Warning: Could not extend the deadline of message %s: %s", msg.ID, err)
+	}
+}
+
+func (w *QueueWorker) runJob(msg *QueueMessage) *QueueCompletion {
+	completion := &QueueCompletion{MessageID: msg.ID}
+	failed := func(status string, err error) *QueueCompletion {
+		completion.Results = &Results{Status: status, Attempt: Attempt{ExitCode: -1}, Error: err.Error()}
+		return completion
+	}
+
+	params, err := LoadParameters(msg.Data, ParamsFormatJSON)
+	if err == nil {
+		completion.JobID = params.JobID
+		err = validateParameters(params)
+	}
+	if err != nil {
+		return failed(StatusInvalidParameters, err)
+	}
+
+	jobRoot, err := newTempJobRoot(w.WorkRoot, "job-")
+	if err != nil {
+		return failed(StatusInternalError, err)
+	}
+	workdir := path.Join(jobRoot.Path, "work")
+
+	log.Printf("Executing job from message %s in %s", msg.ID, workdir)
+	localizer, uploader := w.NewTransfer(jobRoot.Path, workdir)
+	completion.Results, _ = ExecuteResults(context.Background(), workdir, workdir, params, localizer, uploader)
+	jobRoot.cleanupAfter(w.Cleanup, completion.Results.Status)
+	return completion
+}
+
+// MemoryQueue is a Queue held in memory, recording what happens to each
+// message
+type MemoryQueue struct {
+	mutex     sync.Mutex
+	available chan *QueueMessage
+	nextID    int
+	acked     map[string]bool
+	extended  map[string]int
+	published []*QueueMessage
+}
+
+// NewMemoryQueue returns an empty queue, to which messages are added by Push
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{available: make(chan *QueueMessage, 1000),
+		acked:    make(map[string]bool),
+		extended: make(map[string]int)}
+}
+
+// Push adds a message to the queue and returns its id
+func (q *MemoryQueue) Push(data []byte, attributes map[string]string) string {
+	q.mutex.Lock()
+	q.nextID++
+	id := fmt.Sprintf("%d", q.nextID)
+	q.mutex.Unlock()
+
+	q.available <- &QueueMessage{ID: id, Data: data, Attributes: attributes, ackID: id}
+	return id
+}
+
+func (q *MemoryQueue) Receive(ctx context.Context) (*QueueMessage, error) {
+	select {
+	case msg := <-q.available:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+func (q *MemoryQueue) Extend(ctx context.Context, msg *QueueMessage, deadline time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.extended[msg.ackID]++
+	return nil
+}
+
+func (q *MemoryQueue) Ack(ctx context.Context, msg *QueueMessage) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.acked[msg.ackID] = true
+	return nil
+}
+
+func (q *MemoryQueue) Publish(ctx context.Context, data []byte, attributes map[string]string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.published = append(q.published, &QueueMessage{Data: data, Attributes: attributes})
+	return nil
+}
+
+// Acked reports whether the message with the given id was acknowledged
+func (q *MemoryQueue) Acked(id string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.acked[id]
+}
+
+// Extensions returns the number of times the deadline of the message with
+// the given id was extended
+func (q *MemoryQueue) Extensions(id string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.extended[id]
+}
+
+// Published returns the completion messages published so far
+func (q *MemoryQueue) Published() []*QueueMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]*QueueMessage{}, q.published...)
+}
@@ -0,0 +1,66 @@
+package shepherd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	queue := NewMemoryQueue()
+	slow := queue.Push([]byte(`{"job_id": "slow", "command": ["sleep", "0.3"]}`), nil)
+	fails := queue.Push([]byte(`{"job_id": "fails", "command": ["false"]}`), nil)
+	invalid := queue.Push([]byte(`{"job_id": "invalid", "command": []}`), nil)
+
+	worker := &QueueWorker{Queue: queue,
+		WorkRoot:    dir,
+		AckDeadline: 100 * time.Millisecond,
+		NewTransfer: func(jobRoot string, workdir string) (Localizer, Uploader) {
+			return NewMockLocalizer(workdir), NewMockUploader(workdir)
+		}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- worker.Run(ctx) }()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(queue.Published()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	require.Nil(t, <-stopped)
+
+	published := queue.Published()
+	require.Equal(t, 3, len(published))
+	expected := map[string]struct{ jobID, status string }{
+		slow:    {"slow", StatusSuccess},
+		fails:   {"fails", StatusCommandFailed},
+		invalid: {"invalid", StatusInvalidParameters},
+	}
+	for _, msg := range published {
+		var completion QueueCompletion
+		require.Nil(t, json.Unmarshal(msg.Data, &completion))
+		e, ok := expected[completion.MessageID]
+		require.True(t, ok, completion.MessageID)
+		assert.Equal(t, e.jobID, completion.JobID)
+		assert.Equal(t, e.status, completion.Results.Status)
+		assert.Equal(t, completion.MessageID, msg.Attributes[CompletionMessageIDAttribute])
+		assert.Equal(t, e.status, msg.Attributes[CompletionStatusAttribute])
+		assert.True(t, queue.Acked(completion.MessageID))
+	}
+
+	// every deadline is extended as soon as the message is received, and the
+	// slow job outlasted that extension several times over
+	assert.True(t, queue.Extensions(slow) >= 3, "extended %d times", queue.Extensions(slow))
+	assert.Equal(t, 1, queue.Extensions(invalid))
+}
@@ -0,0 +1,82 @@
+package shepherd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ResourceLimits caps the memory and CPU available to the command. Limits are
+// enforced via cgroups v2 for host commands and via docker for containers. A
+// zero value leaves that resource unlimited.
+type ResourceLimits struct {
+	MemoryBytes int64   `json:"memory_bytes"`
+	CPUs        float64 `json:"cpus"`
+}
+
+func validateResourceLimits(v *validator, field string, resources *ResourceLimits) {
+	if resources.MemoryBytes < 0 {
+		v.check(field+".memory_bytes", fmt.Errorf("must not be negative but was %d", resources.MemoryBytes))
+	}
+	if resources.CPUs < 0 {
+		v.check(field+".cpus", fmt.Errorf("must not be negative but was %g", resources.CPUs))
+	}
+}
+
+func dockerResourceArgs(resources *ResourceLimits) []string {
+	args := make([]string, 0, 6)
+	if resources.MemoryBytes > 0 {
+		memory := strconv.FormatInt(resources.MemoryBytes, 10)
+		// setting memory-swap to the same value prevents the container from swapping
+		args = append(args, "--memory", memory, "--memory-swap", memory)
+	}
+	if resources.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(resources.CPUs, 'f', -1, 64))
+	}
+	return args
+}
+
+func newDockerContainerName() string {
+	return fmt.Sprintf("shepherd-%d-%d", os.Getpid(), time.Now().UnixNano())
+}
+
+// dockerOOMKilled asks docker whether the named (and exited) container was
+// killed because it exceeded its memory limit
+func dockerOOMKilled(containerName string) (bool, error) {
+	out, err := exec.Command("docker", "inspect", "--format", "{{.State.OOMKilled}}", containerName).Output()
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.TrimSpace(string(out)))
+}
+
+func killDockerContainer(containerName string) {
+	err := exec.Command("docker", "kill", containerName).Run()
+	if err != nil {
+		log.Printf("Warning: Could not kill container %s: %s", containerName, err)
+	}
+}
+
+func signalDockerContainer(containerName string, sig os.Signal) {
+	signal := sig.String()
+	if s, ok := sig.(syscall.Signal); ok {
+		signal = strconv.Itoa(int(s))
+	}
+	err := exec.Command("docker", "kill", "--signal", signal, containerName).Run()
+	if err != nil {
+		log.Printf("Warning: Could not send %s to container %s: %s", sig, containerName, err)
+	}
+}
+
+func removeDockerContainer(containerName string) {
+	// forced, in case we're giving up on the container before it exited
+	err := exec.Command("docker", "rm", "--force", containerName).Run()
+	if err != nil {
+		log.Printf("Warning: Could not remove container %s: %s", containerName, err)
+	}
+}
@@ -0,0 +1,21 @@
+package shepherd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerResourceArgs(t *testing.T) {
+	assert.Equal(t, []string{}, dockerResourceArgs(&ResourceLimits{}))
+	assert.Equal(t, []string{"--memory", "1073741824", "--memory-swap", "1073741824", "--cpus", "1.5"},
+		dockerResourceArgs(&ResourceLimits{MemoryBytes: 1073741824, CPUs: 1.5}))
+}
+
+func TestValidateResourceLimits(t *testing.T) {
+	params := &Parameters{Command: []string{"true"}, Resources: &ResourceLimits{MemoryBytes: -1}}
+	assert.NotNil(t, validateParameters(params))
+
+	params.Resources = &ResourceLimits{MemoryBytes: 100, CPUs: 0.5}
+	assert.Nil(t, validateParameters(params))
+}
@@ -0,0 +1,81 @@
+package shepherd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// Values for Results.Status
+const (
+	StatusSuccess               = "success"
+	StatusCommandFailed         = "command_failed"
+	StatusInvalidParameters     = "invalid_parameters"
+	StatusInsufficientDiskSpace = "insufficient_disk_space"
+	StatusLocalizationFailed    = "localization_failed"
+	StatusUploadFailed          = "upload_failed"
+	StatusInternalError         = "internal_error"
+	StatusPreempted             = "preempted"
+)
+
+// Attempt describes how a single run of the command ended
+type Attempt struct {
+	ExitCode int `json:"exit_code"`
+	// Signal is the signal which terminated the command, if it did not exit normally
+	Signal     int    `json:"signal,omitempty"`
+	SignalName string `json:"signal_name,omitempty"`
+	TimedOut   bool   `json:"timed_out"`
+	Cancelled  bool   `json:"cancelled"`
+	Preempted  bool   `json:"preempted"`
+	OOMKilled  bool   `json:"oom_killed"`
+}
+
+// Results is written to Parameters.ResultPath once the job completes. It is
+// written even when shepherd fails before or after running the command, in
+// which case ExitCode is -1 if the command never ran and Error describes the
+// failure. The embedded Attempt describes the final run of the command, while
+// Attempts lists every run when retries are enabled.
+type Results struct {
+	Status string `json:"status"`
+	Attempt
+	MemoryLimit int64      `json:"memory_limit,omitempty"`
+	CPULimit    float64    `json:"cpu_limit,omitempty"`
+	Attempts    []*Attempt `json:"attempts,omitempty"`
+	// DiskSpace is the outcome of checking for room for the downloads
+	DiskSpace *DiskSpace `json:"disk_space,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func writeResult(resultPath string, results *Results) error {
+	err := ensureParentDirExists(resultPath)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(resultPath, b, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type signaledStatus interface {
+	Signaled() bool
+	Signal() syscall.Signal
+}
+
+// terminatingSignal returns the signal which killed the process, or zero if
+// it exited normally
+func terminatingSignal(state *os.ProcessState) (int, string) {
+	if status, ok := state.Sys().(signaledStatus); ok && status.Signaled() {
+		return int(status.Signal()), status.Signal().String()
+	}
+	return 0, ""
+}
@@ -0,0 +1,169 @@
+package shepherd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Retry controls re-running a command which failed, for tools which fail
+// transiently (ie: license servers or flaky networks).
+type Retry struct {
+	// MaxAttempts is the total number of times the command may run, including the first
+	MaxAttempts int `json:"max_attempts"`
+	// BackoffSeconds is the delay before the first retry. The delay doubles with each subsequent retry,
+	// up to maxRetryDelay.
+	BackoffSeconds float64 `json:"backoff_seconds"`
+	// ExitCodes lists the exit codes which should be retried. If empty, any failure is retried.
+	ExitCodes []int `json:"exit_codes"`
+	// CleanOutputs removes the files written by a failed attempt before the next one starts
+	CleanOutputs bool `json:"clean_outputs"`
+}
+
+func validateRetry(v *validator, field string, retry *Retry) {
+	if retry.MaxAttempts < 0 {
+		v.check(field+".max_attempts", fmt.Errorf("must not be negative but was %d", retry.MaxAttempts))
+	}
+	if retry.BackoffSeconds < 0 {
+		v.check(field+".backoff_seconds", fmt.Errorf("must not be negative but was %g", retry.BackoffSeconds))
+	}
+}
+
+func shouldRetry(retry *Retry, attempt *Attempt, attemptNumber int) bool {
+	if retry == nil || attemptNumber >= retry.MaxAttempts {
+		return false
+	}
+	if attempt.ExitCode == 0 || attempt.Cancelled || attempt.Preempted {
+		return false
+	}
+	if len(retry.ExitCodes) == 0 {
+		return true
+	}
+	for _, exitCode := range retry.ExitCodes {
+		if exitCode == attempt.ExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRetryDelay caps the delay between attempts, however many there are
+const maxRetryDelay = time.Hour
+
+func retryDelay(retry *Retry, attemptNumber int) time.Duration {
+	seconds := retry.BackoffSeconds * math.Pow(2, float64(attemptNumber-1))
+	// compared as seconds, as larger values overflow a Duration
+	if seconds >= maxRetryDelay.Seconds() {
+		return maxRetryDelay
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// sleepContext waits for the given duration, returning false if ctx was
+// cancelled first
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// everything is a candidate when looking for outputs to clean
+var allFiles = []*Filter{&Filter{Pattern: "*"}}
+
+// listExistingFiles records the files and directories which were present
+// before the command first ran, along with every localized input (in case the
+// command modified it). These are left alone by cleanOutputs.
+func listExistingFiles(workdir string, inputs *inputTracker) (map[string]bool, error) {
+	filenames, err := findNewFiles(workdir, allFiles, inputs)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := listDirs(workdir)
+	if err != nil {
+		return nil, err
+	}
+	inputPaths := inputs.paths()
+	existing := make(map[string]bool, len(filenames)+len(dirs)+len(inputPaths))
+	for _, filename := range filenames {
+		existing[filename] = true
+	}
+	for _, dir := range dirs {
+		existing[dir] = true
+	}
+	for _, inputPath := range inputPaths {
+		existing[inputPath] = true
+	}
+	return existing, nil
+}
+
+// cleanOutputs removes the files and directories created by a previous attempt
+func cleanOutputs(workdir string, existing map[string]bool, localizer HasLocalizedCheck) error {
+	filenames, err := findNewFiles(workdir, allFiles, localizer)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		if existing[filename] {
+			continue
+		}
+		log.Printf("Removing %s left by previous attempt", filename)
+		err = os.Remove(path.Join(workdir, filename))
+		if err != nil {
+			return err
+		}
+	}
+
+	dirs, err := listDirs(workdir)
+	if err != nil {
+		return err
+	}
+	// deepest first, as a directory sorts before those within it
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if existing[dir] {
+			continue
+		}
+		log.Printf("Removing directory %s left by previous attempt", dir)
+		err = os.Remove(path.Join(workdir, dir))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDirs returns the directories within workdir, other than shepherdDir
+func listDirs(workdir string) ([]string, error) {
+	dirs := make([]string, 0)
+	err := filepath.Walk(workdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(workdir, p)
+		if err != nil {
+			return err
+		}
+		if relPath == shepherdDir {
+			return filepath.SkipDir
+		}
+		if relPath != "." {
+			dirs = append(dirs, relPath)
+		}
+		return nil
+	})
+	return dirs, err
+}
@@ -0,0 +1,80 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldRetry(t *testing.T) {
+	retry := &Retry{MaxAttempts: 3, ExitCodes: []int{2}}
+	assert.True(t, shouldRetry(retry, &Attempt{ExitCode: 2}, 1))
+	assert.True(t, shouldRetry(retry, &Attempt{ExitCode: 2}, 2))
+	assert.False(t, shouldRetry(retry, &Attempt{ExitCode: 2}, 3))
+	assert.False(t, shouldRetry(retry, &Attempt{ExitCode: 1}, 1))
+	assert.False(t, shouldRetry(retry, &Attempt{ExitCode: 0}, 1))
+	assert.False(t, shouldRetry(nil, &Attempt{ExitCode: 2}, 1))
+
+	retry = &Retry{MaxAttempts: 2}
+	assert.True(t, shouldRetry(retry, &Attempt{ExitCode: 1}, 1))
+	assert.False(t, shouldRetry(retry, &Attempt{ExitCode: -1, Cancelled: true}, 1))
+
+	retry = &Retry{BackoffSeconds: 0.5}
+	assert.Equal(t, 500*time.Millisecond, retryDelay(retry, 1))
+	assert.Equal(t, 2*time.Second, retryDelay(retry, 3))
+	assert.Equal(t, maxRetryDelay, retryDelay(retry, 100))
+	assert.Equal(t, maxRetryDelay, retryDelay(retry, 5000))
+}
+
+func TestRetry(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	// keep the attempt counter outside of the workdir so it survives cleaning
+	counterDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(counterDir)
+	counter := path.Join(counterDir, "count")
+
+	require.Nil(t, ioutil.WriteFile(path.Join(workDir, "existing"), []byte("keep"), 0644))
+	require.Nil(t, os.Mkdir(path.Join(workDir, "existing-dir"), 0755))
+
+	params := &Parameters{
+		Command:    []string{"bash", "-c", "n=$(cat " + counter + " 2>/dev/null || echo 0); echo $((n+1)) > " + counter + "; echo run $n; echo err $n >&2; touch out-$n; mkdir -p dir-$n/sub; [ $n -ge 2 ] || exit 7"},
+		ResultPath: "results.json",
+		StdoutPath: "logs/stdout.txt",
+		StderrPath: "logs/stderr.txt",
+		Retry:      &Retry{MaxAttempts: 5, ExitCodes: []int{7}, CleanOutputs: true}}
+
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir))
+	require.Nil(t, err)
+
+	results := readResults(t, path.Join(workDir, "results.json"))
+	assert.Equal(t, StatusSuccess, results.Status)
+	assert.Equal(t, 0, results.ExitCode)
+	require.Equal(t, 3, len(results.Attempts))
+	assert.Equal(t, 7, results.Attempts[0].ExitCode)
+	assert.Equal(t, 7, results.Attempts[1].ExitCode)
+	assert.Equal(t, 0, results.Attempts[2].ExitCode)
+
+	for filename, shouldExist := range map[string]bool{
+		"existing": true, "existing-dir": true, "out-0": false, "out-1": false, "out-2": true,
+		"dir-0": false, "dir-1": false, "dir-2/sub": true} {
+		_, err = os.Stat(path.Join(workDir, filename))
+		assert.Equal(t, shouldExist, err == nil, filename)
+	}
+
+	// the logs of failed attempts are kept
+	stdout, err := ioutil.ReadFile(path.Join(workDir, "logs", "stdout.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, "run 0\n--- shepherd: attempt 2 ---\nrun 1\n--- shepherd: attempt 3 ---\nrun 2\n", string(stdout))
+	stderr, err := ioutil.ReadFile(path.Join(workDir, "logs", "stderr.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, "err 0\n--- shepherd: attempt 2 ---\nerr 1\n--- shepherd: attempt 3 ---\nerr 2\n", string(stderr))
+}
@@ -0,0 +1,14 @@
+package shepherd
+
+// Sandbox describes the isolation applied to commands which run directly on
+// the host (ie: when no DockerImage is given). When enabled, the command runs
+// in its own mount and pid namespace where every filesystem except the work
+// directory is read-only.
+type Sandbox struct {
+	DisableNetwork bool `json:"disable_network"`
+}
+
+type sandboxConfig struct {
+	WritablePath string `json:"writable_path"`
+	WorkingDir   string `json:"working_dir"`
+}
@@ -0,0 +1,165 @@
+package shepherd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	prSetNoNewPrivs = 38
+	prCapBSetDrop   = 24
+)
+
+// sandboxCommand arranges for cmd to run inside new user, mount and pid
+// namespaces (and optionally a network namespace). Only writablePath remains
+// writable once the helper has set up the sandbox.
+func sandboxCommand(cmd *exec.Cmd, writablePath string, sandbox *Sandbox, config *helperConfig) error {
+	absWritablePath, err := filepath.Abs(writablePath)
+	if err != nil {
+		return err
+	}
+	absWorkingDir, err := filepath.Abs(cmd.Dir)
+	if err != nil {
+		return err
+	}
+
+	config.Sandbox = &sandboxConfig{WritablePath: absWritablePath, WorkingDir: absWorkingDir}
+
+	cloneflags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if sandbox.DisableNetwork {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  uintptr(cloneflags),
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+
+	return nil
+}
+
+// setupSandbox is run by the exec helper as the first process inside the
+// namespaces created by sandboxCommand.
+func setupSandbox(config *sandboxConfig) error {
+	// make sure nothing we do below propagates back to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("making mounts private: %s", err)
+	}
+
+	// bind the writable path onto itself so that it becomes its own mount which
+	// is left alone when everything else is made read-only
+	err = syscall.Mount(config.WritablePath, config.WritablePath, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("binding %s: %s", config.WritablePath, err)
+	}
+
+	err = remountReadOnly(config.WritablePath)
+	if err != nil {
+		return err
+	}
+
+	// the command gets a private /tmp, unless that would hide the work directory
+	if !strings.HasPrefix(config.WritablePath, "/tmp/") {
+		err = syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+		if err != nil {
+			return fmt.Errorf("mounting /tmp: %s", err)
+		}
+	}
+
+	// and a /proc which matches the new pid namespace
+	err = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("mounting /proc: %s", err)
+	}
+
+	// our cwd still refers to the directory underneath the bind mount
+	err = os.Chdir(config.WorkingDir)
+	if err != nil {
+		return err
+	}
+
+	return dropPrivileges()
+}
+
+// remountReadOnly makes every mount visible to this process read-only, with
+// the exception of writablePath and anything mounted beneath it.
+func remountReadOnly(writablePath string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[4])
+		if mountPoint == writablePath || strings.HasPrefix(mountPoint, writablePath+"/") {
+			continue
+		}
+
+		// flags which were set on the original mount must be preserved, otherwise
+		// the kernel refuses the remount inside a user namespace
+		flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+		for _, option := range strings.Split(fields[5], ",") {
+			flags |= mountOptionFlags[option]
+		}
+
+		err = syscall.Mount("", mountPoint, "", flags, "")
+		if err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("remounting %s read-only: %s", mountPoint, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+var mountOptionFlags = map[string]uintptr{
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+// dropPrivileges empties the capability bounding set so that the command,
+// although uid 0 inside the namespace, cannot undo the read-only mounts.
+func dropPrivileges() error {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return err
+	}
+	lastCap, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return err
+	}
+
+	for c := 0; c <= lastCap; c++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBSetDrop, uintptr(c), 0)
+		if errno != 0 {
+			return fmt.Errorf("dropping capability %d: %s", c, errno)
+		}
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %s", errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package shepherd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSandbox(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	outsideDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(outsideDir)
+	outsideFile := path.Join(outsideDir, "escaped")
+
+	params := &Parameters{
+		Command:    []string{"bash", "-c", "echo -n inside > inside.txt; echo -n outside > " + outsideFile + "; echo $PPID"},
+		Sandbox:    &Sandbox{DisableNetwork: true},
+		StdoutPath: "out.txt",
+		StderrPath: "err.txt"}
+
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir))
+	require.Nil(t, err)
+
+	b, err := ioutil.ReadFile(path.Join(workDir, "inside.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "inside", string(b))
+
+	_, err = os.Stat(outsideFile)
+	assert.True(t, os.IsNotExist(err), "file outside of workdir should not have been created")
+
+	// the command should be in its own pid namespace, started by the helper
+	// as pid 1
+	b, err = ioutil.ReadFile(path.Join(workDir, "out.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1\n", string(b))
+}
+
+func TestSandboxPreemption(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	// without a handler of its own, the command is stopped by the signal
+	// rather than waiting to be killed
+	params := preemptibleParams(`touch started; exec sleep 10`)
+	params.Sandbox = &Sandbox{}
+	preemption := NewPreemption(10 * time.Second)
+	go preemptOnceStarted(workDir, preemption)
+
+	start := time.Now()
+	results, err := ExecutePreemptible(context.Background(), workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir), preemption)
+	require.NotNil(t, err)
+	assert.True(t, time.Since(start) < 3*time.Second)
+	assert.Equal(t, StatusPreempted, results.Status)
+	assert.Equal(t, 128+int(syscall.SIGTERM), results.ExitCode)
+}
+
+func TestSandboxRejectsDocker(t *testing.T) {
+	params := &Parameters{
+		Command:     []string{"true"},
+		DockerImage: "alpine:3.7",
+		Sandbox:     &Sandbox{}}
+	assert.NotNil(t, validateParameters(params))
+}
@@ -0,0 +1,225 @@
+package shepherd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// jsonSchema is the subset of JSON Schema (draft-07) needed to describe
+// Parameters
+type jsonSchema struct {
+	Schema      string                 `json:"$schema,omitempty"`
+	Ref         string                 `json:"$ref,omitempty"`
+	Type        string                 `json:"type,omitempty"`
+	Format      string                 `json:"format,omitempty"`
+	Enum        []string               `json:"enum,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+	Items       *jsonSchema            `json:"items,omitempty"`
+	Definitions map[string]*jsonSchema `json:"definitions,omitempty"`
+	// AdditionalProperties is false for structs and the schema of the
+	// values for maps
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+}
+
+// schemaEnums lists the values allowed for fields which select between
+// options, keyed by "Type.Field". An empty value selects the default.
+var schemaEnums = map[string][]string{
+	"Parameters.InputUploadPolicy": {"", UploadPolicyNever, UploadPolicyIfChanged},
+	"Download.UploadPolicy":        {"", UploadPolicyNever, UploadPolicyIfChanged},
+	"Download.Decompress":          {"", CompressionGzip, CompressionZstd},
+	"UploadPatterns.SymlinkPolicy": {"", SymlinkPolicyFollow, SymlinkPolicySkip, SymlinkPolicyMetadata},
+	"UploadPatterns.Compress":      {"", CompressionGzip, CompressionZstd},
+	"Filter.Type":                  {"", FileTypeRegular, FileTypeSymlink, FileTypeEmpty},
+	"Archive.Format":               {ArchiveFormatTarGz, ArchiveFormatTarZst, ArchiveFormatZip},
+	"ObjectMetadata.StorageClass":  append([]string{""}, storageClasses...),
+	"FailureUploads.Policy":        {"", FailureUploadAll, FailureUploadLogs, FailureUploadSkip},
+}
+
+// schemaRequired lists the fields which must be present, keyed by type
+var schemaRequired = map[string][]string{
+	"Parameters":     {"command"},
+	"Download":       {"source_url", "destination_path"},
+	"UploadPatterns": {"destination_url_prefix"},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// ParametersSchema returns a JSON Schema describing parameter files, which
+// editors can use to complete and check them.
+func ParametersSchema() ([]byte, error) {
+	return json.MarshalIndent(parametersSchema(), "", "  ")
+}
+
+func parametersSchema() *jsonSchema {
+	definitions := make(map[string]*jsonSchema)
+	root := schemaForType(reflect.TypeOf(Parameters{}), definitions)
+	return &jsonSchema{Schema: "http://json-schema.org/draft-07/schema#",
+		Ref:         root.Ref,
+		Definitions: definitions}
+}
+
+// schemaForType describes t, adding the schema of each struct it refers to
+// to definitions
+func schemaForType(t reflect.Type, definitions map[string]*jsonSchema) *jsonSchema {
+	if t == timeType {
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem(), definitions)
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice:
+		return &jsonSchema{Type: "array", Items: schemaForType(t.Elem(), definitions)}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: schemaForType(t.Elem(), definitions)}
+	case reflect.Struct:
+		ref := &jsonSchema{Ref: "#/definitions/" + t.Name()}
+		if _, exists := definitions[t.Name()]; exists {
+			return ref
+		}
+
+		s := &jsonSchema{Type: "object",
+			Properties:           make(map[string]*jsonSchema),
+			Required:             schemaRequired[t.Name()],
+			AdditionalProperties: false}
+		// registered before visiting the fields, in case the struct refers to itself
+		definitions[t.Name()] = s
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			property := schemaForType(field.Type, definitions)
+			property.Enum = schemaEnums[t.Name()+"."+field.Name]
+			s.Properties[name] = property
+		}
+		return ref
+	}
+	panic(fmt.Sprintf("cannot describe %s in a schema", t))
+}
+
+// validateAgainstSchema records a problem with v for every way in which doc,
+// as decoded by json.Decoder with UseNumber, does not conform to s
+func validateAgainstSchema(v *validator, field string, doc interface{}, s *jsonSchema, definitions map[string]*jsonSchema) {
+	if s.Ref != "" {
+		s = definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]
+	}
+	if doc == nil {
+		// null leaves the field at its zero value, as encoding/json does
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			v.check(field, fmt.Errorf("expected an object but got %s", describeJSON(doc)))
+			return
+		}
+		for _, name := range s.Required {
+			if _, exists := obj[name]; !exists {
+				v.check(joinField(field, name), fmt.Errorf("is required"))
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, exists := s.Properties[name]
+			if !exists {
+				if additional, ok := s.AdditionalProperties.(*jsonSchema); ok {
+					property = additional
+				} else {
+					v.check(joinField(field, name), fmt.Errorf("unknown field"))
+					continue
+				}
+			}
+			validateAgainstSchema(v, joinField(field, name), obj[name], property, definitions)
+		}
+	case "array":
+		arr, ok := doc.([]interface{})
+		if !ok {
+			v.check(field, fmt.Errorf("expected an array but got %s", describeJSON(doc)))
+			return
+		}
+		for i, item := range arr {
+			validateAgainstSchema(v, fmt.Sprintf("%s[%d]", field, i), item, s.Items, definitions)
+		}
+	case "string":
+		str, ok := doc.(string)
+		if !ok {
+			v.check(field, fmt.Errorf("expected a string but got %s", describeJSON(doc)))
+			return
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				v.check(field, fmt.Errorf("expected a date-time such as 2006-01-02T15:04:05Z but got %q", str))
+			}
+		}
+		if len(s.Enum) > 0 && !containsString(s.Enum, str) {
+			v.check(field, fmt.Errorf("expected one of %q but got %q", s.Enum, str))
+		}
+	case "boolean":
+		if _, ok := doc.(bool); !ok {
+			v.check(field, fmt.Errorf("expected a boolean but got %s", describeJSON(doc)))
+		}
+	case "integer", "number":
+		n, ok := doc.(json.Number)
+		if !ok {
+			v.check(field, fmt.Errorf("expected a number but got %s", describeJSON(doc)))
+			return
+		}
+		if _, err := n.Int64(); s.Type == "integer" && err != nil {
+			v.check(field, fmt.Errorf("expected an integer but got %s", n))
+		}
+	}
+}
+
+func joinField(field string, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func describeJSON(doc interface{}) string {
+	switch doc.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	}
+	return fmt.Sprintf("%T", doc)
+}
@@ -0,0 +1,103 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishedSchemaIsCurrent(t *testing.T) {
+	schema, err := ParametersSchema()
+	require.Nil(t, err)
+	published, err := ioutil.ReadFile("parameters.schema.json")
+	require.Nil(t, err)
+	assert.Equal(t, string(schema)+"\n", string(published), "regenerate parameters.schema.json with \"shepherd schema\"")
+}
+
+func TestLoadParametersFormats(t *testing.T) {
+	expected := &Parameters{
+		Command: []string{"cp", "in", "out"},
+		Downloads: []*Download{{SourceURL: "gs://bucket/in",
+			DestinationPath: "in",
+			Executable:      true}},
+		Uploads: &UploadPatterns{Filters: []*Filter{{Pattern: "out"}},
+			DestinationURLPrefix: "gs://bucket/out"},
+		TimeoutSeconds: 60}
+
+	documents := map[string]string{
+		ParamsFormatJSON: `{"command": ["cp", "in", "out"],
+			"downloads": [{"source_url": "gs://bucket/in", "destination_path": "in", "executable": true}],
+			"uploads": {"filters": [{"pattern": "out"}], "destination_url_prefix": "gs://bucket/out"},
+			"timeout_seconds": 60}`,
+		ParamsFormatYAML: `
+command: [cp, in, out]
+downloads:
+  - source_url: gs://bucket/in
+    destination_path: in
+    executable: true
+uploads:
+  filters:
+    - pattern: out
+  destination_url_prefix: gs://bucket/out
+timeout_seconds: 60
+`,
+		ParamsFormatTOML: `
+command = ["cp", "in", "out"]
+timeout_seconds = 60
+
+[[downloads]]
+source_url = "gs://bucket/in"
+destination_path = "in"
+executable = true
+
+[uploads]
+destination_url_prefix = "gs://bucket/out"
+
+[[uploads.filters]]
+pattern = "out"
+`,
+	}
+
+	for format, document := range documents {
+		params, err := LoadParameters([]byte(document), format)
+		require.Nil(t, err, format)
+		assert.Equal(t, expected, params, format)
+	}
+}
+
+func TestLoadParametersReportsSchemaErrors(t *testing.T) {
+	_, err := LoadParameters([]byte(`
+command: true
+downloads:
+  - source_url: gs://bucket/in
+    destination: in
+    upload_policy: sometimes
+timeout_seconds: 1.5
+retry:
+  max_attempts: "3"
+`), ParamsFormatYAML)
+	require.NotNil(t, err)
+	validationErr, ok := err.(*ValidationError)
+	require.True(t, ok, err.Error())
+
+	fields := make([]string, len(validationErr.Errors))
+	for i, fieldErr := range validationErr.Errors {
+		fields[i] = fieldErr.Field
+	}
+	assert.Equal(t, []string{"command",
+		"downloads[0].destination_path",
+		"downloads[0].destination",
+		"downloads[0].upload_policy",
+		"retry.max_attempts",
+		"timeout_seconds"}, fields)
+}
+
+func TestParamsFormatForFile(t *testing.T) {
+	assert.Equal(t, ParamsFormatYAML, ParamsFormatForFile("job.yml"))
+	assert.Equal(t, ParamsFormatYAML, ParamsFormatForFile("job.YAML"))
+	assert.Equal(t, ParamsFormatTOML, ParamsFormatForFile("job.toml"))
+	assert.Equal(t, ParamsFormatJSON, ParamsFormatForFile("job.json"))
+	assert.Equal(t, ParamsFormatJSON, ParamsFormatForFile("job"))
+}
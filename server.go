@@ -0,0 +1,495 @@
+package shepherd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values for JobState.State
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobFinished  = "finished"
+	JobCancelled = "cancelled"
+)
+
+// serverLogPath is where the output of submitted jobs which don't set
+// StdoutPath is written, so that it can be served
+var serverLogPath = path.Join(shepherdDir, "output.log")
+
+// JobState is everything the server knows about a submitted job. It is
+// persisted in the server's state directory as it changes.
+type JobState struct {
+	ID          string      `json:"id"`
+	State       string      `json:"state"`
+	SubmittedAt time.Time   `json:"submitted_at"`
+	StartedAt   *time.Time  `json:"started_at,omitempty"`
+	FinishedAt  *time.Time  `json:"finished_at,omitempty"`
+	WorkDir     string      `json:"work_dir,omitempty"`
+	Parameters  *Parameters `json:"parameters"`
+	Results     *Results    `json:"results,omitempty"`
+}
+
+// Server runs jobs submitted over HTTP, a limited number at a time. Every
+// request must carry the server's token as "Authorization: Bearer TOKEN".
+//
+//	POST   /jobs               submits Parameters as JSON, YAML or TOML
+//	                           (by Content-Type) and returns the job's id
+//	GET    /jobs               lists every job
+//	GET    /jobs/{id}          returns the job's state and results
+//	GET    /jobs/{id}/log      returns the last lines of the job's stdout
+//	                           (?stream=stderr for stderr, ?lines=N)
+//	DELETE /jobs/{id}          cancels a queued or running job
+//
+// Job state is kept in a state directory, so that history survives a
+// restart. Jobs which were queued when the server stopped are run once it
+// restarts, while those which were running are recorded as failed.
+type Server struct {
+	stateDir    string
+	workRoot    string
+	cleanup     string
+	token       string
+	newTransfer TransferFactory
+	slots       chan bool
+	running     sync.WaitGroup
+
+	mutex    sync.Mutex
+	jobs     map[string]*JobState
+	cancels  map[string]context.CancelFunc
+	stopping bool
+}
+
+// maxSubmitBytes limits the size of submitted parameters
+const maxSubmitBytes = 1 << 20
+
+// NewServer loads the state of previously submitted jobs from stateDir.
+// Requests must present token, which must not be empty.
+func NewServer(stateDir string, workRoot string, concurrency int, cleanup string, token string, newTransfer TransferFactory) (*Server, error) {
+	if token == "" {
+		return nil, errors.New("the server requires a token")
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	s := &Server{stateDir: stateDir,
+		workRoot:    workRoot,
+		cleanup:     cleanup,
+		token:       token,
+		newTransfer: newTransfer,
+		slots:       make(chan bool, concurrency),
+		jobs:        make(map[string]*JobState),
+		cancels:     make(map[string]context.CancelFunc)}
+
+	err := ensureDirExists(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	requeue := make([]*JobState, 0)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(stateDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		job := &JobState{}
+		err = json.Unmarshal(b, job)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %s", entry.Name(), err)
+		}
+		s.jobs[job.ID] = job
+
+		switch job.State {
+		case JobQueued:
+			requeue = append(requeue, job)
+		case JobRunning:
+			now := time.Now()
+			job.State = JobFinished
+			job.FinishedAt = &now
+			job.Results = &Results{Status: StatusInternalError,
+				Attempt: Attempt{ExitCode: -1},
+				Error:   "the server stopped while the job was running"}
+			err = s.save(job)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(requeue, func(i, j int) bool { return requeue[i].SubmittedAt.Before(requeue[j].SubmittedAt) })
+	for _, job := range requeue {
+		s.start(job)
+	}
+	return s, nil
+}
+
+// Handler returns the HTTP API of the server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("a valid bearer token is required"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(s.token)) == 1
+}
+
+// Stop cancels the running jobs and waits for them to record their state.
+// Queued jobs are left queued, to run once the server restarts, and no more
+// are accepted.
+func (s *Server) Stop() {
+	s.mutex.Lock()
+	s.stopping = true
+	for _, cancel := range s.cancels {
+		cancel()
+	}
+	s.mutex.Unlock()
+	s.running.Wait()
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mutex.Lock()
+		jobs := make([]*JobState, 0, len(s.jobs))
+		for _, job := range s.jobs {
+			copied := *job
+			jobs = append(jobs, &copied)
+		}
+		s.mutex.Unlock()
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].SubmittedAt.Before(jobs[j].SubmittedAt) })
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		s.submit(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not supported on /jobs", r.Method))
+	}
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	id := parts[0]
+	s.mutex.Lock()
+	job, exists := s.jobs[id]
+	var copied JobState
+	if exists {
+		copied = *job
+	}
+	s.mutex.Unlock()
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job with id %q", id))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, &copied)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.cancel(w, id)
+	case len(parts) == 2 && parts[1] == "log" && r.Method == http.MethodGet:
+		s.tailLog(w, r, &copied)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s %s is not supported", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	format := ParamsFormatJSON
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		format = ParamsFormatYAML
+	case "application/toml":
+		format = ParamsFormatTOML
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSubmitBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	params, err := LoadParameters(body, format)
+	if err == nil {
+		err = validateParameters(params)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if params.StdoutPath == "" {
+		params.StdoutPath = serverLogPath
+		params.StderrPath = serverLogPath
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	job := &JobState{ID: id, State: JobQueued, SubmittedAt: time.Now(), Parameters: params}
+
+	s.mutex.Lock()
+	if s.stopping {
+		s.mutex.Unlock()
+		writeError(w, http.StatusServiceUnavailable, errors.New("the server is stopping"))
+		return
+	}
+	s.jobs[id] = job
+	err = s.save(job)
+	s.mutex.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("Accepted job %s", id)
+	s.start(job)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+}
+
+// start runs the job in the background once a slot is free
+func (s *Server) start(job *JobState) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mutex.Lock()
+	s.cancels[job.ID] = cancel
+	s.mutex.Unlock()
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer cancel()
+		select {
+		case s.slots <- true:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-s.slots }()
+		if ctx.Err() != nil {
+			return
+		}
+		s.run(ctx, job)
+	}()
+}
+
+func (s *Server) run(ctx context.Context, job *JobState) {
+	s.mutex.Lock()
+	if job.State != JobQueued {
+		s.mutex.Unlock()
+		return
+	}
+	jobRoot, err := newTempJobRoot(s.workRoot, "job-"+job.ID+"-")
+	now := time.Now()
+	job.StartedAt = &now
+	job.State = JobRunning
+	if err == nil {
+		job.WorkDir = path.Join(jobRoot.Path, "work")
+		err = s.save(job)
+	}
+	s.mutex.Unlock()
+
+	var results *Results
+	if err == nil {
+		log.Printf("Running job %s in %s", job.ID, job.WorkDir)
+		localizer, uploader := s.newTransfer(jobRoot.Path, job.WorkDir)
+		results, _ = ExecuteResults(ctx, job.WorkDir, job.WorkDir, job.Parameters, localizer, uploader)
+		jobRoot.cleanupAfter(s.cleanup, results.Status)
+	} else {
+		results = &Results{Status: StatusInternalError, Attempt: Attempt{ExitCode: -1}, Error: err.Error()}
+		if jobRoot != nil {
+			jobRoot.cleanupAfter(s.cleanup, results.Status)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now = time.Now()
+	job.FinishedAt = &now
+	job.Results = results
+	if ctx.Err() != nil {
+		job.State = JobCancelled
+	} else {
+		job.State = JobFinished
+	}
+	delete(s.cancels, job.ID)
+	err = s.save(job)
+	if err != nil {
+		log.Printf("Warning: Could not save the state of job %s: %s", job.ID, err)
+	}
+	log.Printf("Job %s finished with status %s", job.ID, results.Status)
+}
+
+func (s *Server) cancel(w http.ResponseWriter, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job := s.jobs[id]
+	switch job.State {
+	case JobQueued:
+		now := time.Now()
+		job.State = JobCancelled
+		job.FinishedAt = &now
+		err := s.save(job)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	case JobRunning:
+		// the job records its own state once the command has been killed
+	default:
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s has already %s", id, job.State))
+		return
+	}
+
+	if cancel, exists := s.cancels[id]; exists {
+		cancel()
+	}
+	log.Printf("Cancelled job %s", id)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": id})
+}
+
+func (s *Server) tailLog(w http.ResponseWriter, r *http.Request, job *JobState) {
+	logPath := job.Parameters.StdoutPath
+	if r.URL.Query().Get("stream") == "stderr" {
+		logPath = job.Parameters.StderrPath
+	}
+	lines := 100
+	if n := r.URL.Query().Get("lines"); n != "" {
+		var err error
+		lines, err = strconv.Atoi(n)
+		if err != nil || lines < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("lines must be a non-negative integer but was %q", n))
+			return
+		}
+	}
+	if job.WorkDir == "" || logPath == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s has no log", job.ID))
+		return
+	}
+
+	b, err := ioutil.ReadFile(path.Join(job.WorkDir, logPath))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %s has no log yet", job.ID))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(tailLines(b, lines))
+}
+
+// tailLines returns the last n lines of b
+func tailLines(b []byte, n int) []byte {
+	if n == 0 {
+		return nil
+	}
+	end := len(b)
+	if end > 0 && b[end-1] == '\n' {
+		end--
+	}
+	start := end
+	for i := 0; i < n; i++ {
+		start = bytes.LastIndexByte(b[:start], '\n')
+		if start < 0 {
+			return b
+		}
+	}
+	return b[start+1:]
+}
+
+// save persists the state of the job. The caller must hold s.mutex.
+func (s *Server) save(job *JobState) error {
+	b, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	// written to a temporary file first, so a crash never leaves partial state
+	filename := path.Join(s.stateDir, job.ID+".json")
+	err = ioutil.WriteFile(filename+".tmp", b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+type errorResponse struct {
+	Error    string          `json:"error"`
+	Problems []*fieldProblem `json:"problems,omitempty"`
+}
+
+type fieldProblem struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// writeError responds with the error, listing each problem separately for a
+// *ValidationError
+func writeError(w http.ResponseWriter, status int, err error) {
+	response := &errorResponse{Error: err.Error()}
+	if validationErr, ok := err.(*ValidationError); ok {
+		for _, fieldErr := range validationErr.Errors {
+			response.Problems = append(response.Problems, &fieldProblem{Field: fieldErr.Field, Error: fieldErr.Err.Error()})
+		}
+	}
+	writeJSON(w, status, response)
+}
@@ -0,0 +1,213 @@
+package shepherd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "secret"
+
+func newTestServer(t *testing.T, dir string) (*Server, *httptest.Server) {
+	server, err := NewServer(path.Join(dir, "state"), dir, 1, CleanupKeep, testToken, func(jobRoot string, workdir string) (Localizer, Uploader) {
+		return NewMockLocalizer(workdir), NewMockUploader(workdir)
+	})
+	require.Nil(t, err)
+	return server, httptest.NewServer(server.Handler())
+}
+
+func request(t *testing.T, method string, url string, contentType string, body string) (int, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.Nil(t, err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	return resp.StatusCode, b
+}
+
+func submitJob(t *testing.T, baseURL string, contentType string, params string) string {
+	status, body := request(t, http.MethodPost, baseURL+"/jobs", contentType, params)
+	require.Equal(t, http.StatusCreated, status, string(body))
+	response := make(map[string]string)
+	require.Nil(t, json.Unmarshal(body, &response))
+	return response["id"]
+}
+
+func waitForJob(t *testing.T, baseURL string, id string, states ...string) *JobState {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, body := request(t, http.MethodGet, baseURL+"/jobs/"+id, "", "")
+		require.Equal(t, http.StatusOK, status)
+		job := &JobState{}
+		require.Nil(t, json.Unmarshal(body, job))
+		for _, state := range states {
+			if job.State == state {
+				return job
+			}
+		}
+		require.True(t, time.Now().Before(deadline), "job %s is still %s", id, job.State)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerRunsJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, ts := newTestServer(t, dir)
+	defer ts.Close()
+
+	id := submitJob(t, ts.URL, "application/yaml", "command: [bash, -c, \"echo one; echo two; echo three\"]\n")
+	job := waitForJob(t, ts.URL, id, JobFinished)
+	assert.Equal(t, StatusSuccess, job.Results.Status)
+
+	status, body := request(t, http.MethodGet, ts.URL+"/jobs/"+id+"/log?lines=2", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "two\nthree\n", string(body))
+
+	status, body = request(t, http.MethodGet, ts.URL+"/jobs", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	jobs := []*JobState{}
+	require.Nil(t, json.Unmarshal(body, &jobs))
+	assert.Len(t, jobs, 1)
+
+	status, body = request(t, http.MethodPost, ts.URL+"/jobs", "", `{"command": [], "downloads": [{"source_url": "x"}]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	response := &errorResponse{}
+	require.Nil(t, json.Unmarshal(body, response))
+	assert.Equal(t, "downloads[0].destination_path", response.Problems[0].Field)
+
+	status, _ = request(t, http.MethodGet, ts.URL+"/jobs/missing", "", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestServerCancelsJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, ts := newTestServer(t, dir)
+	defer ts.Close()
+
+	running := submitJob(t, ts.URL, "", `{"command": ["sleep", "60"]}`)
+	queued := submitJob(t, ts.URL, "", `{"command": ["true"]}`)
+	waitForJob(t, ts.URL, running, JobRunning)
+
+	status, _ := request(t, http.MethodDelete, ts.URL+"/jobs/"+queued, "", "")
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, JobCancelled, waitForJob(t, ts.URL, queued, JobCancelled).State)
+
+	status, _ = request(t, http.MethodDelete, ts.URL+"/jobs/"+running, "", "")
+	assert.Equal(t, http.StatusAccepted, status)
+	job := waitForJob(t, ts.URL, running, JobCancelled)
+	assert.True(t, job.Results.Cancelled)
+
+	status, _ = request(t, http.MethodDelete, ts.URL+"/jobs/"+running, "", "")
+	assert.Equal(t, http.StatusConflict, status)
+}
+
+func TestServerRestoresState(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	stateDir := path.Join(dir, "state")
+	require.Nil(t, os.MkdirAll(stateDir, 0755))
+	for _, job := range []*JobState{
+		{ID: "interrupted", State: JobRunning, Parameters: &Parameters{Command: []string{"true"}}},
+		{ID: "queued", State: JobQueued, Parameters: &Parameters{Command: []string{"true"}}},
+	} {
+		b, err := json.Marshal(job)
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(path.Join(stateDir, job.ID+".json"), b, 0644))
+	}
+
+	_, ts := newTestServer(t, dir)
+	defer ts.Close()
+
+	interrupted := waitForJob(t, ts.URL, "interrupted", JobFinished)
+	assert.Equal(t, StatusInternalError, interrupted.Results.Status)
+	queued := waitForJob(t, ts.URL, "queued", JobFinished)
+	assert.Equal(t, StatusSuccess, queued.Results.Status)
+}
+
+func TestServerRequiresToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, ts := newTestServer(t, dir)
+	defer ts.Close()
+
+	for _, header := range []string{"", "Bearer wrong", testToken} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/jobs/missing", nil)
+		require.Nil(t, err)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, header)
+	}
+
+	_, err = NewServer(path.Join(dir, "state"), dir, 1, CleanupKeep, "", nil)
+	assert.NotNil(t, err)
+}
+
+func TestServerRejectsLargeSubmissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, ts := newTestServer(t, dir)
+	defer ts.Close()
+
+	params := `{"command": ["echo", "` + strings.Repeat("x", maxSubmitBytes) + `"]}`
+	status, body := request(t, http.MethodPost, ts.URL+"/jobs", "", params)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, string(body), "too large")
+}
+
+func TestServerStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	server, ts := newTestServer(t, dir)
+	defer ts.Close()
+
+	running := submitJob(t, ts.URL, "", `{"command": ["sleep", "60"]}`)
+	queued := submitJob(t, ts.URL, "", `{"command": ["true"]}`)
+	waitForJob(t, ts.URL, running, JobRunning)
+
+	start := time.Now()
+	server.Stop()
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	job := waitForJob(t, ts.URL, running, JobCancelled)
+	assert.True(t, job.Results.Cancelled)
+	// left to run once the server restarts
+	assert.Equal(t, JobQueued, waitForJob(t, ts.URL, queued, JobQueued).State)
+
+	status, _ := request(t, http.MethodPost, ts.URL+"/jobs", "", `{"command": ["true"]}`)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestTailLines(t *testing.T) {
+	assert.Equal(t, "b\nc\n", string(tailLines([]byte("a\nb\nc\n"), 2)))
+	assert.Equal(t, "b\nc", string(tailLines([]byte("a\nb\nc"), 2)))
+	assert.Equal(t, "a\nb\n", string(tailLines([]byte("a\nb\n"), 5)))
+	assert.Equal(t, "", string(tailLines([]byte("a\nb\n"), 0)))
+}
@@ -0,0 +1,269 @@
+package shepherd
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directories within a spool
+const (
+	SpoolIncoming = "incoming"
+	SpoolClaimed  = "claimed"
+	SpoolDone     = "done"
+	SpoolFailed   = "failed"
+)
+
+// Spool is a queue of job files in a directory. Jobs are dropped into its
+// incoming directory and claimed by a worker by moving them into the
+// worker's own directory within claimed. Once run, a job is moved to done or
+// failed, next to a file named after it with ".results.json" appended. Files
+// whose names start with "." are ignored, so jobs can be written under such a
+// name and then renamed into place.
+type Spool struct {
+	Dir string
+}
+
+// Init creates the directories of the spool
+func (s *Spool) Init() error {
+	for _, dir := range []string{SpoolIncoming, SpoolClaimed, SpoolDone, SpoolFailed} {
+		err := ensureDirExists(path.Join(s.Dir, dir))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The claim directory of each worker is locked for as long as the worker runs
+const (
+	spoolWorkerPrefix = "worker-"
+	spoolLockName     = ".lock"
+)
+
+// ClaimDir is the directory within claimed into which a worker moves the
+// jobs it runs. It stays locked until closed, so that jobs left behind by a
+// worker which stopped without completing them can be told apart from those
+// of a worker which is still running.
+type ClaimDir struct {
+	Path string
+	lock *os.File
+}
+
+// NewClaimDir creates and locks a claim directory for a worker. It's created
+// under a name starting with "." and renamed once locked, so that it's never
+// seen unlocked.
+func (s *Spool) NewClaimDir() (*ClaimDir, error) {
+	claimedRoot := path.Join(s.Dir, SpoolClaimed)
+	tmp, err := ioutil.TempDir(claimedRoot, "."+spoolWorkerPrefix)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(path.Join(tmp, spoolLockName))
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	dir := path.Join(claimedRoot, strings.TrimPrefix(path.Base(tmp), "."))
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		lock.Close()
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	return &ClaimDir{Path: dir, lock: lock}, nil
+}
+
+// Close removes the claim directory, which should no longer hold any jobs,
+// and releases its lock
+func (d *ClaimDir) Close() error {
+	defer d.lock.Close()
+	err := os.Remove(path.Join(d.Path, spoolLockName))
+	if err != nil {
+		return err
+	}
+	return os.Remove(d.Path)
+}
+
+// RecoverOrphans fails the jobs left in the claim directories of workers
+// which are no longer running, returning their paths within failed. They
+// aren't returned to incoming, as the job itself may be why the worker
+// stopped.
+func (s *Spool) RecoverOrphans() ([]string, error) {
+	claimedRoot := path.Join(s.Dir, SpoolClaimed)
+	entries, err := ioutil.ReadDir(claimedRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	recovered := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), spoolWorkerPrefix) {
+			continue
+		}
+		dir := &ClaimDir{Path: path.Join(claimedRoot, entry.Name())}
+		dir.lock, err = lockFile(path.Join(dir.Path, spoolLockName))
+		if err != nil {
+			// the worker is still running
+			continue
+		}
+
+		jobs, err := ioutil.ReadDir(dir.Path)
+		if err != nil {
+			dir.lock.Close()
+			return recovered, err
+		}
+		for _, job := range jobs {
+			if job.IsDir() || strings.HasPrefix(job.Name(), ".") {
+				continue
+			}
+			log.Printf("Failing %s, as the worker which claimed it stopped before completing it", job.Name())
+			results := &Results{Status: StatusInternalError,
+				Attempt: Attempt{ExitCode: -1},
+				Error:   "the worker running the job stopped before it completed"}
+			err = s.Complete(path.Join(dir.Path, job.Name()), results)
+			if err != nil {
+				dir.lock.Close()
+				return recovered, err
+			}
+			recovered = append(recovered, path.Join(s.Dir, SpoolFailed, job.Name()))
+		}
+
+		err = dir.Close()
+		if err != nil {
+			return recovered, err
+		}
+	}
+	return recovered, nil
+}
+
+// Claim moves the oldest incoming job into dir and returns its new path, or
+// "" if there are no jobs waiting. Renaming is atomic, so each job is claimed
+// by exactly one worker.
+func (s *Spool) Claim(dir *ClaimDir) (string, error) {
+	incoming := path.Join(s.Dir, SpoolIncoming)
+	entries, err := ioutil.ReadDir(incoming)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		claimed := path.Join(dir.Path, entry.Name())
+		err = os.Rename(path.Join(incoming, entry.Name()), claimed)
+		if os.IsNotExist(err) {
+			// another worker got there first
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return claimed, nil
+	}
+	return "", nil
+}
+
+// Complete writes the results of a claimed job and moves it to done or failed
+func (s *Spool) Complete(claimed string, results *Results) error {
+	dir := SpoolFailed
+	if results.Status == StatusSuccess {
+		dir = SpoolDone
+	}
+	dest := path.Join(s.Dir, dir, path.Base(claimed))
+
+	// written first, so the results are there as soon as the job appears
+	err := writeResult(dest+".results.json", results)
+	if err != nil {
+		return err
+	}
+	return os.Rename(claimed, dest)
+}
+
+// Worker runs the jobs of a spool one at a time, each in a new directory
+// within WorkRoot, checking for new jobs every PollInterval.
+type Worker struct {
+	Spool        *Spool
+	WorkRoot     string
+	PollInterval time.Duration
+	Cleanup      string
+	NewTransfer  TransferFactory
+}
+
+// Run processes jobs until ctx is cancelled. A job which is already running
+// when that happens is allowed to complete. Jobs left behind by workers which
+// stopped while running them are failed first.
+func (w *Worker) Run(ctx context.Context) error {
+	err := w.Spool.Init()
+	if err != nil {
+		return err
+	}
+	_, err = w.Spool.RecoverOrphans()
+	if err != nil {
+		return err
+	}
+	claimDir, err := w.Spool.NewClaimDir()
+	if err != nil {
+		return err
+	}
+	defer claimDir.Close()
+
+	for ctx.Err() == nil {
+		claimed, err := w.Spool.Claim(claimDir)
+		if err != nil {
+			return err
+		}
+		if claimed == "" {
+			sleepContext(ctx, w.PollInterval)
+			continue
+		}
+
+		log.Printf("Claimed %s", claimed)
+		results := w.runJob(claimed)
+		log.Printf("Job %s finished with status %s", claimed, results.Status)
+		err = w.Spool.Complete(claimed, results)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Worker stopped")
+	return nil
+}
+
+func (w *Worker) runJob(claimed string) *Results {
+	failed := func(status string, err error) *Results {
+		return &Results{Status: status, Attempt: Attempt{ExitCode: -1}, Error: err.Error()}
+	}
+
+	buf, err := ioutil.ReadFile(claimed)
+	if err != nil {
+		return failed(StatusInternalError, err)
+	}
+	params, err := LoadParameters(buf, ParamsFormatForFile(claimed))
+	if err == nil {
+		err = validateParameters(params)
+	}
+	if err != nil {
+		return failed(StatusInvalidParameters, err)
+	}
+
+	jobRoot, err := newTempJobRoot(w.WorkRoot, "job-")
+	if err != nil {
+		return failed(StatusInternalError, err)
+	}
+	workdir := path.Join(jobRoot.Path, "work")
+
+	log.Printf("Executing %s in %s", claimed, workdir)
+	localizer, uploader := w.NewTransfer(jobRoot.Path, workdir)
+	results, _ := ExecuteResults(context.Background(), workdir, workdir, params, localizer, uploader)
+	jobRoot.cleanupAfter(w.Cleanup, results.Status)
+	return results
+}
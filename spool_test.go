@@ -0,0 +1,129 @@
+package shepherd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	spool := &Spool{Dir: dir}
+	require.Nil(t, spool.Init())
+	claimDir, err := spool.NewClaimDir()
+	require.Nil(t, err)
+	assert.Equal(t, path.Join(dir, SpoolClaimed), path.Dir(claimDir.Path))
+
+	claimed, err := spool.Claim(claimDir)
+	require.Nil(t, err)
+	assert.Equal(t, "", claimed)
+
+	require.Nil(t, ioutil.WriteFile(path.Join(dir, SpoolIncoming, ".partial.json"), []byte("{"), 0644))
+	require.Nil(t, ioutil.WriteFile(path.Join(dir, SpoolIncoming, "job.json"), []byte("{}"), 0644))
+
+	claimed, err = spool.Claim(claimDir)
+	require.Nil(t, err)
+	assert.Equal(t, path.Join(claimDir.Path, "job.json"), claimed)
+
+	claimed, err = spool.Claim(claimDir)
+	require.Nil(t, err)
+	assert.Equal(t, "", claimed)
+}
+
+func TestSpoolRecoverOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	spool := &Spool{Dir: dir}
+	require.Nil(t, spool.Init())
+	for _, name := range []string{"orphan.json", "running.json"} {
+		require.Nil(t, ioutil.WriteFile(path.Join(dir, SpoolIncoming, name), []byte("{}"), 0644))
+	}
+
+	stopped, err := spool.NewClaimDir()
+	require.Nil(t, err)
+	orphan, err := spool.Claim(stopped)
+	require.Nil(t, err)
+	// as if the worker had exited without closing its claim directory
+	require.Nil(t, stopped.lock.Close())
+
+	running, err := spool.NewClaimDir()
+	require.Nil(t, err)
+	defer running.Close()
+	claimed, err := spool.Claim(running)
+	require.Nil(t, err)
+
+	recovered, err := spool.RecoverOrphans()
+	require.Nil(t, err)
+	assert.Equal(t, []string{path.Join(dir, SpoolFailed, path.Base(orphan))}, recovered)
+	results := readResults(t, path.Join(dir, SpoolFailed, path.Base(orphan)+".results.json"))
+	assert.Equal(t, StatusInternalError, results.Status)
+	_, err = os.Stat(stopped.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	// the job of the running worker is left alone
+	assert.FileExists(t, claimed)
+}
+
+func TestWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	spool := &Spool{Dir: dir}
+	require.Nil(t, spool.Init())
+	jobs := map[string]string{
+		"ok.json":      `{"command": ["true"]}`,
+		"fails.yaml":   "command: [\"false\"]\n",
+		"invalid.json": `{"command": []}`,
+	}
+	for name, content := range jobs {
+		require.Nil(t, ioutil.WriteFile(path.Join(dir, SpoolIncoming, name), []byte(content), 0644))
+	}
+
+	workRoot := path.Join(dir, "work")
+	require.Nil(t, os.Mkdir(workRoot, 0755))
+	worker := &Worker{Spool: spool,
+		WorkRoot:     workRoot,
+		PollInterval: 10 * time.Millisecond,
+		NewTransfer: func(jobRoot string, workdir string) (Localizer, Uploader) {
+			return NewMockLocalizer(workdir), NewMockUploader(workdir)
+		}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- worker.Run(ctx) }()
+
+	completed := func() int {
+		done, _ := ioutil.ReadDir(path.Join(dir, SpoolDone))
+		failed, _ := ioutil.ReadDir(path.Join(dir, SpoolFailed))
+		return len(done) + len(failed)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for completed() < 2*len(jobs) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	require.Nil(t, <-stopped)
+
+	assert.FileExists(t, path.Join(dir, SpoolDone, "ok.json"))
+	assert.Equal(t, StatusSuccess, readResults(t, path.Join(dir, SpoolDone, "ok.json.results.json")).Status)
+	assert.FileExists(t, path.Join(dir, SpoolFailed, "fails.yaml"))
+	assert.Equal(t, StatusCommandFailed, readResults(t, path.Join(dir, SpoolFailed, "fails.yaml.results.json")).Status)
+	assert.FileExists(t, path.Join(dir, SpoolFailed, "invalid.json"))
+	assert.Equal(t, StatusInvalidParameters, readResults(t, path.Join(dir, SpoolFailed, "invalid.json.results.json")).Status)
+
+	incoming, err := ioutil.ReadDir(path.Join(dir, SpoolIncoming))
+	require.Nil(t, err)
+	assert.Empty(t, incoming)
+}
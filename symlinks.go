@@ -0,0 +1,86 @@
+package shepherd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Values for UploadPatterns.SymlinkPolicy
+const (
+	// SymlinkPolicyFollow uploads the file a symlink points to, provided it lies
+	// within the work directory. This is the default.
+	SymlinkPolicyFollow = "follow"
+	// SymlinkPolicySkip never uploads symlinks
+	SymlinkPolicySkip = "skip"
+	// SymlinkPolicyMetadata uploads an empty object recording the target of the
+	// symlink in its metadata, under SymlinkTargetMetadataKey
+	SymlinkPolicyMetadata = "metadata"
+)
+
+// SymlinkTargetMetadataKey is the object metadata key which holds the target
+// of a symlink uploaded with SymlinkPolicyMetadata
+const SymlinkTargetMetadataKey = "shepherd-symlink-target"
+
+func validateSymlinkPolicy(policy string) error {
+	switch policy {
+	case "", SymlinkPolicyFollow, SymlinkPolicySkip, SymlinkPolicyMetadata:
+		return nil
+	}
+	return fmt.Errorf("unknown symlink policy %q, expected %q, %q or %q", policy, SymlinkPolicyFollow, SymlinkPolicySkip, SymlinkPolicyMetadata)
+}
+
+// applySymlinkPolicy decides whether uploadRec should be uploaded if its
+// source is a symlink, filling in SymlinkTarget when the link itself is to be
+// recorded rather than what it points to.
+func applySymlinkPolicy(workdir string, policy string, uploadRec *Upload) (bool, error) {
+	absPath := path.Join(workdir, uploadRec.SourcePath)
+	fi, err := os.Lstat(absPath)
+	if err != nil {
+		return false, err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return true, nil
+	}
+
+	switch policy {
+	case SymlinkPolicySkip:
+		log.Printf("Skipping symlink %s", uploadRec.SourcePath)
+		return false, nil
+	case SymlinkPolicyMetadata:
+		target, err := os.Readlink(absPath)
+		if err != nil {
+			return false, err
+		}
+		uploadRec.SymlinkTarget = target
+		return true, nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		log.Printf("Warning: Skipping symlink %s which could not be resolved: %s", uploadRec.SourcePath, err)
+		return false, nil
+	}
+	resolvedWorkdir, err := filepath.EvalSymlinks(workdir)
+	if err != nil {
+		return false, err
+	}
+	if resolved != resolvedWorkdir && !strings.HasPrefix(resolved, resolvedWorkdir+string(filepath.Separator)) {
+		log.Printf("Warning: Refusing to follow symlink %s which points outside of the work directory to %s", uploadRec.SourcePath, resolved)
+		return false, nil
+	}
+
+	resolvedInfo, err := os.Stat(resolved)
+	if err != nil {
+		return false, err
+	}
+	if resolvedInfo.IsDir() {
+		// anything within it is already visited through its real path
+		return false, nil
+	}
+
+	return true, nil
+}
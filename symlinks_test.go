@@ -0,0 +1,56 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSymlinkPolicy(t *testing.T, policy string) map[string]string {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	outsideDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(outsideDir)
+	secret := path.Join(outsideDir, "secret")
+	require.Nil(t, ioutil.WriteFile(secret, []byte("secret"), 0644))
+
+	params := &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{&Filter{Pattern: "*"}},
+			DestinationURLPrefix: "gs://mock",
+			SymlinkPolicy:        policy},
+		Command: []string{"bash", "-c", "echo -n data > real && ln -s real inside && ln -s " + secret + " outside && mkdir d && ln -s d dirlink"}}
+
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.Nil(t, err)
+
+	return uploadedOutputs(t, uploader)
+}
+
+func TestSymlinkPolicyFollow(t *testing.T) {
+	assert.Equal(t, map[string]string{"gs://mock/real": "data", "gs://mock/inside": "data"},
+		testSymlinkPolicy(t, SymlinkPolicyFollow))
+	// follow is the default
+	assert.Equal(t, map[string]string{"gs://mock/real": "data", "gs://mock/inside": "data"},
+		testSymlinkPolicy(t, ""))
+}
+
+func TestSymlinkPolicySkip(t *testing.T) {
+	assert.Equal(t, map[string]string{"gs://mock/real": "data"},
+		testSymlinkPolicy(t, SymlinkPolicySkip))
+}
+
+func TestSymlinkPolicyMetadata(t *testing.T) {
+	uploaded := testSymlinkPolicy(t, SymlinkPolicyMetadata)
+	assert.Equal(t, "data", uploaded["gs://mock/real"])
+	assert.Equal(t, "symlink to real", uploaded["gs://mock/inside"])
+	assert.Equal(t, "symlink to d", uploaded["gs://mock/dirlink"])
+	assert.Contains(t, uploaded["gs://mock/outside"], "symlink to /")
+}
@@ -0,0 +1,88 @@
+package shepherd
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// uploadRules returns the rules used to decide where outputs are uploaded to,
+// in the order they are applied. Uploads, if set, is treated as the first rule.
+func (params *Parameters) uploadRules() []*UploadPatterns {
+	rules := make([]*UploadPatterns, 0, len(params.UploadRules)+1)
+	if params.Uploads != nil {
+		rules = append(rules, params.Uploads)
+	}
+	return append(rules, params.UploadRules...)
+}
+
+// renameData is made available to UploadPatterns.Rename templates
+type renameData struct {
+	// Path is the path of the file relative to the work directory, after StripComponents has been applied
+	Path string
+	// Dir is the directory portion of Path, or "." if there is none
+	Dir string
+	// Name is the final element of Path
+	Name string
+	// Stem is Name without its extension
+	Stem string
+	// Ext is the extension of Name, including the leading "."
+	Ext string
+}
+
+// pathRewriter maps the path of an output to the path it is uploaded to,
+// relative to the destination prefix of its rule
+type pathRewriter struct {
+	stripComponents int
+	rename          *template.Template
+}
+
+func newPathRewriter(rule *UploadPatterns) (*pathRewriter, error) {
+	if rule.StripComponents < 0 {
+		return nil, fmt.Errorf("strip_components must not be negative but was %d", rule.StripComponents)
+	}
+
+	r := &pathRewriter{stripComponents: rule.StripComponents}
+	if rule.Rename != "" {
+		t, err := template.New("rename").Option("missingkey=error").Parse(rule.Rename)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rename template %q: %s", rule.Rename, err)
+		}
+		r.rename = t
+	}
+	return r, nil
+}
+
+func (r *pathRewriter) rewrite(relPath string) (string, error) {
+	p := stripComponents(relPath, r.stripComponents)
+
+	if r.rename != nil {
+		name := path.Base(p)
+		ext := path.Ext(name)
+		data := &renameData{Path: p, Dir: path.Dir(p), Name: name, Stem: strings.TrimSuffix(name, ext), Ext: ext}
+
+		var buf bytes.Buffer
+		err := r.rename.Execute(&buf, data)
+		if err != nil {
+			return "", fmt.Errorf("could not rename %s: %s", relPath, err)
+		}
+		p = path.Clean(buf.String())
+	}
+
+	if p == "." || strings.HasPrefix(p, "/") || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("%s was rewritten to %q which is not a relative path within the destination", relPath, p)
+	}
+	return p, nil
+}
+
+// stripComponents removes the first n directories from relPath. The file name
+// itself is never removed.
+func stripComponents(relPath string, n int) string {
+	parts := strings.Split(relPath, "/")
+	if n >= len(parts) {
+		n = len(parts) - 1
+	}
+	return strings.Join(parts[n:], "/")
+}
@@ -0,0 +1,117 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathRewriter(t *testing.T) {
+	cases := []struct {
+		rule     *UploadPatterns
+		path     string
+		expected string
+	}{
+		{&UploadPatterns{}, "a/b/c.txt", "a/b/c.txt"},
+		{&UploadPatterns{StripComponents: 1}, "a/b/c.txt", "b/c.txt"},
+		{&UploadPatterns{StripComponents: 5}, "a/b/c.txt", "c.txt"},
+		{&UploadPatterns{Rename: "{{.Stem}}-final{{.Ext}}"}, "a/c.txt", "c-final.txt"},
+		{&UploadPatterns{Rename: "{{.Dir}}/renamed/{{.Name}}"}, "a/b/c.txt", "a/b/renamed/c.txt"},
+		{&UploadPatterns{StripComponents: 1, Rename: "{{.Path}}.bak"}, "a/b/c.txt", "b/c.txt.bak"},
+	}
+
+	for _, c := range cases {
+		r, err := newPathRewriter(c.rule)
+		require.Nil(t, err)
+		p, err := r.rewrite(c.path)
+		require.Nil(t, err)
+		assert.Equal(t, c.expected, p)
+	}
+
+	r, err := newPathRewriter(&UploadPatterns{Rename: "../{{.Name}}"})
+	require.Nil(t, err)
+	_, err = r.rewrite("a.txt")
+	assert.NotNil(t, err)
+
+	_, err = newPathRewriter(&UploadPatterns{Rename: "{{.Name"})
+	assert.NotNil(t, err)
+}
+
+func TestUploadRules(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		UploadRules: []*UploadPatterns{
+			{Filters: []*Filter{{Pattern: "*.log"}}, DestinationURLPrefix: "gs://logs/job"},
+			{Filters: []*Filter{{Pattern: "results/"}}, DestinationURLPrefix: "gs://results/job", StripComponents: 1},
+			{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://other/job", Rename: "{{.Stem}}.v1{{.Ext}}"},
+		},
+		Command: []string{"bash", "-c", "mkdir results && echo -n a > results/a.csv && echo -n l > run.log && echo -n x > x.bin"}}
+
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.Nil(t, err)
+
+	assert.Equal(t, "l", uploader.uploaded["gs://logs/job/run.log"])
+	assert.Equal(t, "a", uploader.uploaded["gs://results/job/a.csv"])
+	assert.Equal(t, "x", uploader.uploaded["gs://other/job/x.v1.bin"])
+	for _, prefix := range []string{"gs://logs/job/", "gs://results/job/", "gs://other/job/"} {
+		assert.Contains(t, uploader.uploaded, prefix+ManifestName)
+	}
+	assert.Equal(t, 6, len(uploader.uploaded))
+}
+
+func TestUploadRulesCollision(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		UploadRules: []*UploadPatterns{
+			{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://out", StripComponents: 1},
+		},
+		Command: []string{"bash", "-c", "mkdir a b && touch a/x b/x"}}
+
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), NewMockUploader(workDir))
+	assert.NotNil(t, err)
+}
+
+func TestUploadRulesManifestCollision(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{{Pattern: "*"}}, DestinationURLPrefix: "gs://out"},
+		Command: []string{"touch", ManifestName}}
+
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "the manifest")
+	assert.Equal(t, 0, len(uploader.uploaded))
+}
+
+func TestUploadRulesCollisionUploadsNothing(t *testing.T) {
+	workDir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	params := &Parameters{
+		UploadRules: []*UploadPatterns{
+			{Filters: []*Filter{{Pattern: "a/*"}}, DestinationURLPrefix: "gs://out", StripComponents: 1},
+			{Filters: []*Filter{{Pattern: "b/*"}}, DestinationURLPrefix: "gs://out", StripComponents: 1},
+		},
+		Command: []string{"bash", "-c", "mkdir a b && touch a/x b/x"}}
+
+	// the first rule's uploads would be fine alone, but aren't made
+	uploader := NewMockUploader(workDir)
+	err = Execute(workDir, workDir, params, NewMockLocalizer(workDir), uploader)
+	require.NotNil(t, err)
+	assert.Equal(t, 0, len(uploader.uploaded))
+}
@@ -0,0 +1,203 @@
+package shepherd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats of parameter files
+const (
+	ParamsFormatJSON = "json"
+	ParamsFormatYAML = "yaml"
+	ParamsFormatTOML = "toml"
+)
+
+// FieldError is a problem with a single field of the parameters. Field is
+// the path to it within the JSON parameters, such as
+// "downloads[3].destination_path".
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+// ValidationError lists every problem found with a set of parameters
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Errors) == 1 {
+		return "invalid parameters: " + e.Errors[0].Error()
+	}
+	messages := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		messages[i] = "  " + fieldErr.Error()
+	}
+	return fmt.Sprintf("invalid parameters, found %d problems:\n%s", len(e.Errors), strings.Join(messages, "\n"))
+}
+
+// errNull is reported for null entries of lists of objects
+var errNull = errors.New("must not be null")
+
+// validator collects the problems found while validating parameters
+type validator struct {
+	errors []*FieldError
+}
+
+// check records err, if any, against field
+func (v *validator) check(field string, err error) {
+	if err != nil {
+		v.errors = append(v.errors, &FieldError{Field: field, Err: err})
+	}
+}
+
+// err returns a *ValidationError if any problems were found
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errors}
+}
+
+// ValidateParameters checks that params describe a job which Execute could
+// run, returning a *ValidationError listing every problem found.
+func ValidateParameters(params *Parameters) error {
+	return validateParameters(params)
+}
+
+// ParseParameters decodes JSON parameters, rejecting any fields which
+// Parameters does not define.
+func ParseParameters(data []byte) (*Parameters, error) {
+	params := &Parameters{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the parameters")
+	}
+	return params, nil
+}
+
+// ParamsFormatForFile picks the format of a parameter file from its extension,
+// defaulting to JSON
+func ParamsFormatForFile(filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".yaml", ".yml":
+		return ParamsFormatYAML
+	case ".toml":
+		return ParamsFormatTOML
+	}
+	return ParamsFormatJSON
+}
+
+// LoadParameters decodes parameters written in the given format. The
+// document is first checked against ParametersSchema, so that every unknown
+// field and value of the wrong type is reported in a *ValidationError.
+func LoadParameters(data []byte, format string) (*Parameters, error) {
+	jsonData, err := convertToJSON(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	err = decoder.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := parametersSchema()
+	v := &validator{}
+	validateAgainstSchema(v, "", doc, schema, schema.Definitions)
+	err = v.err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseParameters(jsonData)
+}
+
+// convertToJSON re-encodes YAML and TOML documents as JSON, so that the
+// same field names and checks apply whatever the format
+func convertToJSON(data []byte, format string) ([]byte, error) {
+	var doc interface{}
+	switch format {
+	case ParamsFormatJSON:
+		return data, nil
+	case ParamsFormatYAML:
+		err := yaml.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse YAML: %s", err)
+		}
+		doc, err = normalizeYAML(doc)
+		if err != nil {
+			return nil, err
+		}
+	case ParamsFormatTOML:
+		table := make(map[string]interface{})
+		_, err := toml.Decode(string(data), &table)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse TOML: %s", err)
+		}
+		doc = table
+	default:
+		return nil, fmt.Errorf("unknown parameters format %q, expected %q, %q or %q", format, ParamsFormatJSON, ParamsFormatYAML, ParamsFormatTOML)
+	}
+	return json.Marshal(doc)
+}
+
+// normalizeYAML converts the maps decoded by yaml, which may have keys of any
+// type, into maps with string keys which can be encoded as JSON
+func normalizeYAML(doc interface{}) (interface{}, error) {
+	switch value := doc.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("YAML keys must be strings but got %v", key)
+			}
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			normalized[name] = n
+		}
+		return normalized, nil
+	case map[string]interface{}:
+		for key, item := range value {
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = n
+		}
+		return value, nil
+	case []interface{}:
+		for i, item := range value {
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = n
+		}
+		return value, nil
+	}
+	return doc, nil
+}
@@ -0,0 +1,96 @@
+package shepherd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidationReportsAllErrors(t *testing.T) {
+	params := &Parameters{
+		Uploads: &UploadPatterns{Filters: []*Filter{{Pattern: "*"}, {Pattern: "[a"}}, DestinationURLPrefix: "gs://bucket/out"},
+		UploadRules: []*UploadPatterns{
+			{DestinationURLPrefix: "s3://bucket/out", StripComponents: -1},
+		},
+		Downloads: []*Download{
+			{SourceURL: "gs://bucket/a", DestinationPath: "a"},
+			{SourceURL: "gs://bucket/b", DestinationPath: "../b"},
+		},
+		TimeoutSeconds: -1}
+
+	err := validateParameters(params)
+	require.NotNil(t, err)
+	validationErr, ok := err.(*ValidationError)
+	require.True(t, ok)
+
+	fields := make([]string, len(validationErr.Errors))
+	for i, fieldErr := range validationErr.Errors {
+		fields[i] = fieldErr.Field
+	}
+	assert.Equal(t, []string{"command",
+		"uploads.filters[1].pattern",
+		"upload_rules[0].destination_url_prefix",
+		"upload_rules[0].strip_components",
+		"downloads[1].destination_path",
+		"timeout_seconds"}, fields)
+	assert.Contains(t, err.Error(), "found 6 problems")
+}
+
+func TestValidationNestedFields(t *testing.T) {
+	params := &Parameters{Command: []string{"true"},
+		Uploads:     &UploadPatterns{Filters: []*Filter{nil, {}, {Regex: "("}}, DestinationURLPrefix: "gs://bucket/out"},
+		UploadRules: []*UploadPatterns{nil},
+		Downloads:   []*Download{nil},
+		Resources:   &ResourceLimits{CPUs: -1},
+		Retry:       &Retry{MaxAttempts: -1, BackoffSeconds: -1},
+		OnFailure:   &FailureUploads{Policy: "some"}}
+
+	err := validateParameters(params)
+	require.NotNil(t, err)
+	validationErr, ok := err.(*ValidationError)
+	require.True(t, ok)
+
+	fields := make([]string, len(validationErr.Errors))
+	for i, fieldErr := range validationErr.Errors {
+		fields[i] = fieldErr.Field
+	}
+	assert.Equal(t, []string{"uploads.filters[0]",
+		"uploads.filters[1]",
+		"uploads.filters[2].regex",
+		"upload_rules[0]",
+		"downloads[0]",
+		"resources.cpus",
+		"retry.max_attempts",
+		"retry.backoff_seconds",
+		"on_failure.policy"}, fields)
+	assert.Contains(t, err.Error(), "downloads[0]: must not be null")
+}
+
+func TestParseParametersWithNulls(t *testing.T) {
+	for _, document := range []string{
+		`{"command": ["true"], "downloads": [null]}`,
+		`{"command": ["true"], "upload_rules": [null]}`,
+		`{"command": ["true"], "uploads": {"destination_url_prefix": "gs://bucket/out", "filters": [null]}}`,
+	} {
+		params, err := ParseParameters([]byte(document))
+		require.Nil(t, err, document)
+		err = validateParameters(params)
+		require.NotNil(t, err, document)
+		assert.Contains(t, err.Error(), "must not be null", document)
+	}
+}
+
+func TestParseParameters(t *testing.T) {
+	params, err := ParseParameters([]byte(`{"command": ["true"], "downloads": [{"source_url": "gs://bucket/a", "destination_path": "a"}]}`))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"true"}, params.Command)
+	assert.Equal(t, "a", params.Downloads[0].DestinationPath)
+
+	_, err = ParseParameters([]byte(`{"command": ["true"], "downloads": [{"source_url": "gs://bucket/a", "destination": "a"}]}`))
+	assert.NotNil(t, err)
+	_, err = ParseParameters([]byte(`{"command": ["true"]} {}`))
+	assert.NotNil(t, err)
+	_, err = ParseParameters([]byte(`{"command": `))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,256 @@
+package shepherd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What happens to the directory of a job once it has run
+const (
+	CleanupKeep            = "keep"
+	CleanupDeleteOnSuccess = "delete-on-success"
+	CleanupDeleteAlways    = "delete-always"
+)
+
+// jobRootMarker is created in every job directory, so that gc only ever
+// considers directories which shepherd created. It stays locked while the
+// job runs.
+const jobRootMarker = ".shepherd-job"
+
+// procMounts lists the mounted filesystems, one per line
+var procMounts = "/proc/mounts"
+
+// ValidateCleanupPolicy checks that policy is one of the cleanup policies
+func ValidateCleanupPolicy(policy string) error {
+	if policy != CleanupKeep && policy != CleanupDeleteOnSuccess && policy != CleanupDeleteAlways {
+		return fmt.Errorf("cleanup policy must be %q, %q or %q but was %q", CleanupKeep, CleanupDeleteOnSuccess, CleanupDeleteAlways, policy)
+	}
+	return nil
+}
+
+// JobRoot is the directory of a job, which stays locked until Cleanup is
+// called or the process exits
+type JobRoot struct {
+	Path string
+	lock *os.File
+}
+
+// NewJobRoot creates the directory for a job within workRoot. If name is
+// empty, a unique one starting with "tmp-work-" is chosen. Otherwise the
+// directory is created with that name, and must not already exist so that
+// nothing is left over from an earlier job.
+func NewJobRoot(workRoot string, name string) (*JobRoot, error) {
+	if name == "" {
+		return newTempJobRoot(workRoot, "tmp-work-")
+	}
+
+	if name == "." || name == ".." || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("work directory name must not be a path but was %q", name)
+	}
+	err := ensureDirExists(workRoot)
+	if err != nil {
+		return nil, err
+	}
+	jobRoot := path.Join(workRoot, name)
+	err = os.Mkdir(jobRoot, 0777)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%s already exists", jobRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return markJobRoot(jobRoot)
+}
+
+// newTempJobRoot creates the directory for a job within workRoot, with a
+// unique name starting with prefix
+func newTempJobRoot(workRoot string, prefix string) (*JobRoot, error) {
+	err := ensureDirExists(workRoot)
+	if err != nil {
+		return nil, err
+	}
+	jobRoot, err := ioutil.TempDir(workRoot, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return markJobRoot(jobRoot)
+}
+
+// markJobRoot creates and locks the marker of a new job directory
+func markJobRoot(jobRoot string) (*JobRoot, error) {
+	lock, err := lockFile(path.Join(jobRoot, jobRootMarker))
+	if err != nil {
+		os.RemoveAll(jobRoot)
+		return nil, err
+	}
+	return &JobRoot{Path: jobRoot, lock: lock}, nil
+}
+
+// Cleanup removes the job's directory if policy calls for it, given the
+// status the job finished with, and releases its lock. An empty policy keeps
+// the directory.
+func (r *JobRoot) Cleanup(policy string, status string) error {
+	defer r.lock.Close()
+	if policy == "" || policy == CleanupKeep || (policy == CleanupDeleteOnSuccess && status != StatusSuccess) {
+		return nil
+	}
+	log.Printf("Removing %s", r.Path)
+	return removeJobRoot(r.Path)
+}
+
+// cleanupAfter is Cleanup for jobs run by long-lived processes, which carry
+// on when the directory can't be removed
+func (r *JobRoot) cleanupAfter(policy string, status string) {
+	err := r.Cleanup(policy, status)
+	if err != nil {
+		log.Printf("Warning: Could not remove %s: %s", r.Path, err)
+	}
+}
+
+// CollectGarbage removes the job directories within workRoot in which nothing
+// has changed for at least olderThan, and returns their paths. Only
+// directories created by shepherd are considered, and those of jobs which are
+// still running are skipped. With dryRun, they're returned without being
+// removed.
+func CollectGarbage(workRoot string, olderThan time.Duration, dryRun bool) ([]string, error) {
+	entries, err := ioutil.ReadDir(workRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	removed := make([]string, 0)
+	for _, entry := range entries {
+		jobRoot := path.Join(workRoot, entry.Name())
+		marker := path.Join(jobRoot, jobRootMarker)
+		if !entry.IsDir() || !isRegularFile(marker) {
+			continue
+		}
+		// held until the directory is gone, so no other gc removes it too
+		lock, err := lockFile(marker)
+		if err != nil {
+			// the job is still running
+			continue
+		}
+		modified, err := lastModified(jobRoot)
+		if err == nil && modified.Before(cutoff) {
+			if !dryRun {
+				err = removeJobRoot(jobRoot)
+			}
+			if err == nil {
+				removed = append(removed, jobRoot)
+			}
+		}
+		lock.Close()
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func isRegularFile(filename string) bool {
+	fi, err := os.Lstat(filename)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// lastModified returns the newest modification time of anything within
+// jobRoot, without descending into mounted buckets
+func lastModified(jobRoot string) (time.Time, error) {
+	abs, err := filepath.Abs(jobRoot)
+	if err != nil {
+		return time.Time{}, err
+	}
+	mounts, err := mountsWithin(abs)
+	if err != nil {
+		return time.Time{}, err
+	}
+	isMount := make(map[string]bool, len(mounts))
+	for _, mount := range mounts {
+		isMount[mount] = true
+	}
+
+	var newest time.Time
+	err = filepath.Walk(abs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isMount[p] {
+			return filepath.SkipDir
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest, err
+}
+
+// removeJobRoot deletes jobRoot, unless a bucket is still mounted within it,
+// in which case deleting would reach into the bucket
+func removeJobRoot(jobRoot string) error {
+	mounts, err := mountsWithin(jobRoot)
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return fmt.Errorf("not removing %s as %s is still mounted within it", jobRoot, strings.Join(mounts, ", "))
+	}
+	return os.RemoveAll(jobRoot)
+}
+
+// mountsWithin returns the mount points within dir, or none where mounts
+// can't be listed
+func mountsWithin(dir string) ([]string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(procMounts)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]string, 0)
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[1])
+		if mountPoint == abs || strings.HasPrefix(mountPoint, abs+"/") {
+			mounts = append(mounts, mountPoint)
+		}
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath decodes the octal escapes (ie: "\040" for a space) used
+// for paths in /proc/mounts and /proc/self/mountinfo
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
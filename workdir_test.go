@@ -0,0 +1,141 @@
+package shepherd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewJobRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	workRoot := path.Join(dir, "root")
+
+	jobRoot, err := NewJobRoot(workRoot, "")
+	require.Nil(t, err)
+	assert.Equal(t, workRoot, path.Dir(jobRoot.Path))
+	assert.True(t, strings.HasPrefix(path.Base(jobRoot.Path), "tmp-work-"))
+	require.Nil(t, jobRoot.Cleanup(CleanupKeep, StatusSuccess))
+
+	jobRoot, err = NewJobRoot(workRoot, "fixed")
+	require.Nil(t, err)
+	assert.Equal(t, path.Join(workRoot, "fixed"), jobRoot.Path)
+	assert.FileExists(t, path.Join(jobRoot.Path, jobRootMarker))
+
+	_, err = NewJobRoot(workRoot, "fixed")
+	assert.NotNil(t, err)
+	_, err = NewJobRoot(workRoot, "../escape")
+	assert.NotNil(t, err)
+}
+
+func TestCleanupJobRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		policy  string
+		status  string
+		removed bool
+	}{
+		{CleanupKeep, StatusSuccess, false},
+		{"", StatusSuccess, false},
+		{CleanupDeleteOnSuccess, StatusCommandFailed, false},
+		{CleanupDeleteOnSuccess, StatusSuccess, true},
+		{CleanupDeleteAlways, StatusCommandFailed, true},
+	} {
+		jobRoot, err := NewJobRoot(dir, "")
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(path.Join(jobRoot.Path, "out"), []byte("x"), 0644))
+
+		require.Nil(t, jobRoot.Cleanup(tc.policy, tc.status))
+		_, err = os.Stat(jobRoot.Path)
+		assert.Equal(t, tc.removed, os.IsNotExist(err), "%s with %s", tc.policy, tc.status)
+	}
+}
+
+func TestCleanupJobRootLeavesMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	jobRoot, err := NewJobRoot(dir, "")
+	require.Nil(t, err)
+	abs, err := filepath.Abs(jobRoot.Path)
+	require.Nil(t, err)
+
+	mounts := path.Join(dir, "mounts")
+	require.Nil(t, ioutil.WriteFile(mounts, []byte("bucket "+abs+"/my\\040bucket fuse.gcsfuse rw 0 0\n"), 0644))
+	defer func(orig string) { procMounts = orig }(procMounts)
+	procMounts = mounts
+
+	assert.NotNil(t, jobRoot.Cleanup(CleanupDeleteAlways, StatusSuccess))
+	assert.DirExists(t, jobRoot.Path)
+}
+
+// makeOld sets the times of everything within dir to long ago
+func makeOld(t *testing.T, dir string) {
+	old := time.Now().Add(-48 * time.Hour)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, old, old)
+	})
+	require.Nil(t, err)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	newJob := func(name string) *JobRoot {
+		jobRoot, err := NewJobRoot(dir, name)
+		require.Nil(t, err)
+		require.Nil(t, os.MkdirAll(path.Join(jobRoot.Path, "work", "a", "b", "c"), 0755))
+		return jobRoot
+	}
+
+	stale := newJob("stale")
+	require.Nil(t, stale.Cleanup(CleanupKeep, StatusSuccess))
+	makeOld(t, stale.Path)
+
+	// still being written to, deep within the work directory
+	active := newJob("active")
+	require.Nil(t, active.Cleanup(CleanupKeep, StatusSuccess))
+	makeOld(t, active.Path)
+	require.Nil(t, ioutil.WriteFile(path.Join(active.Path, "work", "a", "b", "c", "out"), []byte("x"), 0644))
+
+	// the job is still running, however long ago it last wrote anything
+	running := newJob("running")
+	defer running.Cleanup(CleanupKeep, StatusSuccess)
+	makeOld(t, running.Path)
+
+	// not created by shepherd, even if named like its directories
+	other := path.Join(dir, "tmp-work-other")
+	require.Nil(t, os.Mkdir(other, 0755))
+	makeOld(t, other)
+
+	removed, err := CollectGarbage(dir, 24*time.Hour, true)
+	require.Nil(t, err)
+	assert.Equal(t, []string{stale.Path}, removed)
+	assert.DirExists(t, stale.Path)
+
+	removed, err = CollectGarbage(dir, 24*time.Hour, false)
+	require.Nil(t, err)
+	assert.Equal(t, []string{stale.Path}, removed)
+	_, err = os.Stat(stale.Path)
+	assert.True(t, os.IsNotExist(err))
+	assert.DirExists(t, active.Path)
+	assert.DirExists(t, running.Path)
+	assert.DirExists(t, other)
+}